@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"math"
+	"sync"
+)
+
+var (
+	anonymize    = flag.Bool("anonymize", false, "whether to replace names with hashed IDs and drop phone numbers, addresses, links and inspection numbers in the output, rounding coordinates to a coarse grid; the DB is left untouched")
+	anonymizeKey = flag.String("anonymize-key", "", "secret key the -anonymize IDs are derived from, so they're stable across exports; a random key is used for each run if empty")
+)
+
+// anonymizeGrid is how many cells per degree the grid -anonymize rounds
+// coordinates to has, about a kilometre each.
+const anonymizeGrid = 100
+
+var (
+	anonymousKeyOnce sync.Once
+	anonymousKey     []byte
+)
+
+// anonymousID returns an ID for r that doesn't reveal which restaurant it is.
+// Restaurant IDs are public, so they're hashed with a secret key; otherwise
+// hashing every known ID would undo it.
+func anonymousID(r *restaurant) string {
+	anonymousKeyOnce.Do(func() {
+		anonymousKey = []byte(*anonymizeKey)
+		if len(anonymousKey) > 0 {
+			return
+		}
+		anonymousKey = make([]byte, 32)
+		rand.Read(anonymousKey)
+	})
+	mac := hmac.New(sha256.New, anonymousKey)
+	mac.Write([]byte(r.ID))
+	return hex.EncodeToString(mac.Sum(nil)[:6])
+}
+
+func roundToGrid(v float64) float64 {
+	return math.Round(v*anonymizeGrid) / anonymizeGrid
+}
+
+// anonymizeRestaurants returns redacted copies of rs that keep the community
+// and infraction history but nothing that singles out a business.
+func anonymizeRestaurants(rs []*restaurant) []*restaurant {
+	out := make([]*restaurant, 0, len(rs))
+	for _, r := range rs {
+		c := *r
+		c.ID = anonymousID(r)
+		c.Name = c.ID
+		c.SiteAddress = ""
+		c.PhoneNumber = ""
+		c.MoreDetailsURL = ""
+		c.DetailHash = ""
+		c.RawRows = nil
+		if c.LatLong != (latLong{}) {
+			c.LatLong = latLong{Lat: roundToGrid(c.LatLong.Lat), Long: roundToGrid(c.LatLong.Long)}
+		}
+		c.Inspections = make([]inspection, len(r.Inspections))
+		for i, in := range r.Inspections {
+			// Inspection numbers are public too and lead straight back to
+			// the restaurant.
+			in.Number = ""
+			in.FollowsUp = ""
+			in.InferredFollowsUp = ""
+			in.ReportURL = ""
+			c.Inspections[i] = in
+		}
+		out = append(out, &c)
+	}
+	return out
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+var checkURLs = flag.Bool("check-urls", false, "whether to check that the details URLs of the selected restaurants are reachable instead of fetching them")
+
+// head returns the status code of a HEAD request for addr.
+func head(addr string) (int, error) {
+	req, err := newRequest("HEAD", addr)
+	if err != nil {
+		return 0, err
+	}
+	throttleBulk(req.URL.Host)
+	infof("Checking: %s", addr)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// checkRestaurantURLs HEADs the details URL of every selected restaurant in
+// the DB and prints the ones that don't return 200 OK.
+func checkRestaurantURLs() error {
+	db := makeDB()
+	if err := db.load(); err != nil {
+		return err
+	}
+	rs := db.getSelectedRestaurants()
+
+	rsChan := make(chan *restaurant, *workersFetch)
+	var mu sync.Mutex
+	broken := 0
+	var wg sync.WaitGroup
+	for i := 0; i < *workersFetch; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for r := range rsChan {
+				status, err := head(r.MoreDetailsURL)
+				if err == nil && status == http.StatusOK {
+					continue
+				}
+				mu.Lock()
+				broken++
+				if err != nil {
+					fmt.Printf("error %s %s: %s\n", r.ID, r.MoreDetailsURL, err)
+				} else {
+					fmt.Printf("%d %s %s\n", status, r.ID, r.MoreDetailsURL)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, r := range rs {
+		rsChan <- r
+	}
+	close(rsChan)
+	wg.Wait()
+
+	infof("%d of %d details URLs are broken", broken, len(rs))
+	return nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+var (
+	webhook      = flag.String("webhook", "", "URL to POST to when a restaurant gains outstanding critical infractions")
+	slackWebhook = flag.String("slack-webhook", "", "Slack incoming webhook URL to alert when a restaurant gains outstanding critical infractions")
+)
+
+var compare = flag.Bool("compare", false, "whether to print the differences between the two DB files given as arguments")
+
+type restaurantChange struct {
+	Old, New *restaurant
+}
+
+// newCritical returns how many more outstanding critical infractions the
+// restaurant has than before.
+func (c restaurantChange) newCritical() int {
+	return c.New.OutstandingCriticalInfractions - c.Old.OutstandingCriticalInfractions
+}
+
+type dbDiff struct {
+	Added, Removed []*restaurant
+	// Changed holds restaurants in both DBs whose inspection count or
+	// outstanding critical infractions differ.
+	Changed []restaurantChange
+}
+
+// copyRestaurants returns a deep copy of rs so it can be diffed against after
+// rs is updated in place.
+func copyRestaurants(rs []*restaurant) []*restaurant {
+	out := make([]*restaurant, len(rs))
+	for i, r := range rs {
+		c := *r
+		c.Inspections = append([]inspection(nil), r.Inspections...)
+		out[i] = &c
+	}
+	return out
+}
+
+// diffDBs compares two restaurant lists by ID. Restaurants marked as removed
+// are treated as absent.
+func diffDBs(old, new []*restaurant) dbDiff {
+	oldByID := map[string]*restaurant{}
+	for _, r := range old {
+		if !r.Removed {
+			oldByID[r.ID] = r
+		}
+	}
+	newByID := map[string]*restaurant{}
+	for _, r := range new {
+		if !r.Removed {
+			newByID[r.ID] = r
+		}
+	}
+
+	var d dbDiff
+	for _, r := range new {
+		if r.Removed {
+			continue
+		}
+		o, ok := oldByID[r.ID]
+		if !ok {
+			d.Added = append(d.Added, r)
+			continue
+		}
+		if len(o.Inspections) != len(r.Inspections) || o.OutstandingCriticalInfractions != r.OutstandingCriticalInfractions {
+			d.Changed = append(d.Changed, restaurantChange{Old: o, New: r})
+		}
+	}
+	for _, r := range old {
+		if _, ok := newByID[r.ID]; !ok && !r.Removed {
+			d.Removed = append(d.Removed, r)
+		}
+	}
+	return d
+}
+
+type webhookPayload struct {
+	ID                  string
+	Name                string
+	NewCritical         int
+	OutstandingCritical int
+	MoreDetailsURL      string
+}
+
+type slackAttachment struct {
+	Color     string `json:"color"`
+	Title     string `json:"title"`
+	TitleLink string `json:"title_link"`
+	Text      string `json:"text"`
+	Fallback  string `json:"fallback"`
+}
+
+type slackMessage struct {
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+func slackAlert(c restaurantChange) slackMessage {
+	text := fmt.Sprintf("%d new outstanding critical infractions (%d total)", c.newCritical(), c.New.OutstandingCriticalInfractions)
+	return slackMessage{
+		Attachments: []slackAttachment{{
+			Color:     "danger",
+			Title:     c.New.Name,
+			TitleLink: c.New.MoreDetailsURL,
+			Text:      text,
+			Fallback:  c.New.Name + ": " + text,
+		}},
+	}
+}
+
+// notify alerts -webhook and -slack-webhook about every restaurant in d that
+// gained outstanding critical infractions, including new restaurants that
+// already have some. Failures are logged.
+func notify(d dbDiff) {
+	if len(*webhook) == 0 && len(*slackWebhook) == 0 {
+		return
+	}
+	changes := append([]restaurantChange(nil), d.Changed...)
+	for _, r := range d.Added {
+		changes = append(changes, restaurantChange{Old: &restaurant{}, New: r})
+	}
+	for _, c := range changes {
+		if c.newCritical() <= 0 {
+			continue
+		}
+		if len(*webhook) > 0 {
+			payload := webhookPayload{
+				ID:                  c.New.ID,
+				Name:                c.New.Name,
+				NewCritical:         c.newCritical(),
+				OutstandingCritical: c.New.OutstandingCriticalInfractions,
+				MoreDetailsURL:      c.New.MoreDetailsURL,
+			}
+			if err := postJSON(*webhook, payload); err != nil {
+				logError(err)
+			}
+		}
+		if len(*slackWebhook) > 0 {
+			if err := postJSON(*slackWebhook, slackAlert(c)); err != nil {
+				logError(err)
+			}
+		}
+	}
+}
+
+func postJSON(addr string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(addr, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("POST %s: %s", addr, resp.Status)
+	}
+	return nil
+}
+
+type changeSummary struct {
+	ID, Name                                       string
+	OldInspections, NewInspections                 int
+	OldOutstandingCritical, NewOutstandingCritical int
+}
+
+type diffSummary struct {
+	Added, Removed []*restaurant
+	Changed        []changeSummary
+}
+
+func writeDiff(w io.Writer, d dbDiff) error {
+	if *format == "json" {
+		summary := diffSummary{Added: d.Added, Removed: d.Removed}
+		for _, c := range d.Changed {
+			summary.Changed = append(summary.Changed, changeSummary{
+				ID:                     c.New.ID,
+				Name:                   c.New.Name,
+				OldInspections:         len(c.Old.Inspections),
+				NewInspections:         len(c.New.Inspections),
+				OldOutstandingCritical: c.Old.OutstandingCriticalInfractions,
+				NewOutstandingCritical: c.New.OutstandingCriticalInfractions,
+			})
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(summary)
+	}
+
+	fmt.Fprintf(w, "Added (%d):\n", len(d.Added))
+	for _, r := range d.Added {
+		fmt.Fprintf(w, "  %s (%s)\n", r.Name, r.ID)
+	}
+	fmt.Fprintf(w, "Removed (%d):\n", len(d.Removed))
+	for _, r := range d.Removed {
+		fmt.Fprintf(w, "  %s (%s)\n", r.Name, r.ID)
+	}
+	fmt.Fprintf(w, "Changed (%d):\n", len(d.Changed))
+	for _, c := range d.Changed {
+		_, err := fmt.Fprintf(w, "  %s (%s): inspections %d -> %d, outstanding critical %d -> %d\n",
+			c.New.Name, c.New.ID,
+			len(c.Old.Inspections), len(c.New.Inspections),
+			c.Old.OutstandingCriticalInfractions, c.New.OutstandingCriticalInfractions)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func compareDBs(oldFile, newFile string) error {
+	old := makeDB()
+	if err := old.loadFrom(oldFile); err != nil {
+		return err
+	}
+	new := makeDB()
+	if err := new.loadFrom(newFile); err != nil {
+		return err
+	}
+	return writeDiff(os.Stdout, diffDBs(old.Restaurants, new.Restaurants))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+var downloadReportsDir = flag.String("download-reports", "", "directory to download inspection report PDFs into, one subdirectory per restaurant")
+
+// reportLink returns the link to the inspection report in an inspection row.
+func reportLink(s *goquery.Selection) (string, bool) {
+	var href string
+	s.Find("a[href]").EachWithBreak(func(_ int, a *goquery.Selection) bool {
+		h := a.AttrOr("href", "")
+		lower := strings.ToLower(h)
+		if strings.Contains(lower, "pdf") || strings.Contains(lower, "report") {
+			href = h
+			return false
+		}
+		return true
+	})
+	return href, len(href) > 0
+}
+
+// safeFileNameRegexp matches scraped values that are safe to use as a path
+// component, so a value like "../x" can't write outside the directory.
+var safeFileNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// downloadReports saves the report of every inspection of rs into dir.
+// Reports that were already downloaded are skipped.
+func downloadReports(rs []*restaurant, dir string) {
+	for _, r := range rs {
+		for _, i := range r.Inspections {
+			if len(i.ReportURL) == 0 {
+				continue
+			}
+			if !safeFileNameRegexp.MatchString(r.ID) || !safeFileNameRegexp.MatchString(i.Number) {
+				logError(fmt.Errorf("not downloading %s: restaurant %q inspection %q isn't a safe file name", i.ReportURL, r.ID, i.Number))
+				continue
+			}
+			file := filepath.Join(dir, r.ID, i.Number+".pdf")
+			if _, err := os.Stat(file); err == nil {
+				continue
+			}
+			if err := download(i.ReportURL, file); err != nil {
+				logError(err)
+			}
+		}
+	}
+}
+
+func download(addr, file string) error {
+	req, err := newRequest("GET", addr)
+	if err != nil {
+		return err
+	}
+	throttleBulk(req.URL.Host)
+	infof("Downloading: %s", addr)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("downloading %s: %w", addr, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("downloading %s: %s", addr, resp.Status)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	// Write to a temporary file first so an interrupted download isn't
+	// mistaken for a finished one.
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("downloading %s: %w", addr, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
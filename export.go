@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"os"
+)
+
+var exportSQLitePath = flag.String("export-sqlite", "", "SQLite file to write the DB's restaurants and inspections to, instead of fetching, when built with the sqlite tag")
+
+// sqliteExporter writes the restaurants to a new SQLite file. It's registered
+// by export_sqlite.go so only builds with the sqlite tag need the driver.
+var sqliteExporter func(ctx context.Context, file string, rs []*restaurant) error
+
+// exportSQLite writes the saved DB to -export-sqlite, replacing any existing
+// file.
+func exportSQLite(ctx context.Context) error {
+	if sqliteExporter == nil {
+		return errors.New("-export-sqlite needs a build with -tags sqlite")
+	}
+	db := makeDB()
+	if err := db.load(); err != nil {
+		return err
+	}
+	// The export is built next to the destination and renamed into place so
+	// readers never see a partial file.
+	tmp := *exportSQLitePath + ".tmp"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := sqliteExporter(ctx, tmp, db.Restaurants); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	infof("Exported %d restaurants to %s", len(db.Restaurants), *exportSQLitePath)
+	return os.Rename(tmp, *exportSQLitePath)
+}
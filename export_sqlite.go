@@ -0,0 +1,118 @@
+//go:build sqlite
+
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	_ "modernc.org/sqlite"
+)
+
+func init() {
+	sqliteExporter = writeSQLite
+}
+
+var sqliteSchema = []string{
+	`CREATE TABLE restaurants (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		facility_type TEXT,
+		risk_category TEXT,
+		community TEXT,
+		address TEXT,
+		phone TEXT,
+		url TEXT,
+		lat REAL,
+		lng REAL,
+		outstanding_critical INTEGER,
+		outstanding_non_critical INTEGER,
+		infractions_past_year INTEGER,
+		infractions_total INTEGER,
+		clean_streak INTEGER,
+		critical_ratio REAL,
+		days_since_inspection INTEGER,
+		overdue INTEGER,
+		removed INTEGER
+	)`,
+	`CREATE TABLE inspections (
+		restaurant_id TEXT,
+		date TEXT,
+		number TEXT,
+		reason TEXT,
+		type TEXT,
+		critical INTEGER,
+		non_critical INTEGER,
+		corrected INTEGER,
+		follows_up TEXT,
+		inferred_follows_up TEXT,
+		report_url TEXT
+	)`,
+	`CREATE INDEX restaurants_community ON restaurants(community)`,
+	`CREATE INDEX restaurants_infractions_past_year ON restaurants(infractions_past_year)`,
+	`CREATE INDEX inspections_restaurant_id ON inspections(restaurant_id)`,
+	`CREATE INDEX inspections_date ON inspections(date)`,
+}
+
+// writeSQLite creates file with restaurants and inspections tables holding
+// rs.
+func writeSQLite(ctx context.Context, file string, rs []*restaurant) error {
+	sqlDB, err := sql.Open("sqlite", file)
+	if err != nil {
+		return err
+	}
+	defer sqlDB.Close()
+
+	tx, err := sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range sqliteSchema {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	insertRestaurant, err := tx.PrepareContext(ctx, `INSERT INTO restaurants VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer insertRestaurant.Close()
+	insertInspection, err := tx.PrepareContext(ctx, `INSERT INTO inspections VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer insertInspection.Close()
+
+	for _, r := range rs {
+		// Seeded restaurants may not have an ID yet, and a NULL key doesn't
+		// clash with the others.
+		id := sql.NullString{String: r.ID, Valid: len(r.ID) > 0}
+		if _, err := insertRestaurant.ExecContext(ctx,
+			id, r.Name, r.FacilityType, r.RiskCategory, r.Community,
+			joinAddressLines(r.SiteAddress), r.PhoneNumber, r.MoreDetailsURL,
+			r.LatLong.Lat, r.LatLong.Long,
+			r.OutstandingCriticalInfractions, r.OutstandingNonCriticalInfractions,
+			r.InfractionsPastYear, r.InfractionsTotal, r.CleanStreak, r.CriticalRatio,
+			r.DaysSinceInspection, r.Overdue, r.Removed,
+		); err != nil {
+			return err
+		}
+		for _, i := range r.Inspections {
+			// Dates are stored as YYYY-MM-DD so they sort and can be
+			// compared, or NULL if they can't be parsed.
+			var date sql.NullString
+			if t, err := parseInspectionDate(i.Date); err == nil {
+				date = sql.NullString{String: t.Format("2006-01-02"), Valid: true}
+			}
+			if _, err := insertInspection.ExecContext(ctx,
+				id, date, i.Number, i.Reason, i.Type.String(),
+				i.Critical, i.NonCritical, i.CorrectedCount, i.FollowsUp, i.InferredFollowsUp, i.ReportURL,
+			); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
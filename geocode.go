@@ -0,0 +1,437 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jasonwinn/geocoder"
+)
+
+var (
+	geocodeCacheFile = flag.String("geocode-cache", "", "path to a geocode cache file shared between DBs and runs")
+	geocodeTTL       = flag.Duration("geocode-ttl", 0, "how long geocoded addresses are cached for, 0 caches forever")
+	notFoundTTL      = flag.Duration("geocode-not-found-ttl", 30*24*time.Hour, "how long addresses the geocoder couldn't find are remembered before being tried again")
+	verifyCache      = flag.Bool("verify-cache", false, "whether to list geocode cache entries whose keys don't match the current address normalization instead of fetching")
+	migrateCache     = flag.Bool("migrate-cache", false, "with -verify-cache, whether to re-key mismatched entries and save the DB")
+	pruneCache       = flag.Bool("prune-cache", false, "whether to remove geocode cache entries for addresses no restaurant in the DB has, instead of fetching")
+)
+
+// Geocoders wrap their errors in one of these where they can tell why the
+// lookup failed.
+var (
+	// ErrGeocodeNotFound is returned when the geocoder has no match for an
+	// address.
+	ErrGeocodeNotFound = errors.New("address not found")
+	// ErrGeocodeRateLimited is returned when the geocoder refuses requests
+	// because too many were made.
+	ErrGeocodeRateLimited = errors.New("geocoder rate limited")
+	// ErrGeocodeAuth is returned when the geocoder rejects the API key.
+	ErrGeocodeAuth = errors.New("geocoder rejected the API key")
+	// ErrGeocodeQuotaExceeded is returned when the API key has used up its
+	// quota, usually until the next day.
+	ErrGeocodeQuotaExceeded = errors.New("geocoder quota exceeded")
+)
+
+// geocodeErrorKind returns a short name for the kind of geocode error err is,
+// for summarizing failures.
+func geocodeErrorKind(err error) string {
+	switch {
+	case errors.Is(err, ErrGeocodeNotFound):
+		return "not-found"
+	case errors.Is(err, ErrGeocodeRateLimited):
+		return "rate-limited"
+	case errors.Is(err, ErrGeocodeAuth):
+		return "auth"
+	case errors.Is(err, ErrGeocodeQuotaExceeded):
+		return "quota"
+	default:
+		return "other"
+	}
+}
+
+// Geocoder looks up the coordinates of an address.
+type Geocoder interface {
+	Geocode(address string) (latLong, error)
+}
+
+// BatchGeocoder is implemented by geocoders that can look up many addresses in
+// one request, which is far cheaper than one request per address. The
+// results and errors are in the same order as addresses.
+type BatchGeocoder interface {
+	Geocoder
+	BatchGeocode(addresses []string) ([]latLong, []error)
+}
+
+// geocoders are the providers -geocoder and -geocoder-fallback can name.
+var geocoders = map[string]Geocoder{
+	"mapquest":  mapquestGeocoder{},
+	"nominatim": &nominatimGeocoder{},
+}
+
+var (
+	geocoderName         = flag.String("geocoder", "mapquest", "geocoding provider: mapquest or nominatim")
+	geocoderFallbackName = flag.String("geocoder-fallback", "", "geocoding provider to retry addresses the -geocoder provider fails on, if any")
+)
+
+var (
+	// geocodeProvider is the geocoder used for addresses that aren't
+	// cached.
+	geocodeProvider Geocoder = mapquestGeocoder{}
+	// geocodeFallback is tried when geocodeProvider fails, if set.
+	geocodeFallback Geocoder
+)
+
+// setupGeocoder sets the geocoders from flags.
+func setupGeocoder() error {
+	g, ok := geocoders[*geocoderName]
+	if !ok {
+		return fmt.Errorf("unknown geocoder %q", *geocoderName)
+	}
+	geocodeProvider = g
+	if len(*geocoderFallbackName) == 0 {
+		return nil
+	}
+	if geocodeFallback, ok = geocoders[*geocoderFallbackName]; !ok {
+		return fmt.Errorf("unknown geocoder %q", *geocoderFallbackName)
+	}
+	return nil
+}
+
+// geocodeNonZero geocodes address with g, treating a null island result as not
+// found.
+func geocodeNonZero(g Geocoder, address string) (latLong, error) {
+	ll, err := g.Geocode(address)
+	if err == nil && nullIsland(ll) {
+		return latLong{}, fmt.Errorf("%w: got %v", ErrGeocodeNotFound, ll)
+	}
+	return ll, err
+}
+
+// geocodeWithFallback geocodes address with the primary geocoder, retrying
+// with the fallback if that fails. It returns the name of the provider that
+// resolved the address.
+func geocodeWithFallback(address string) (latLong, string, error) {
+	ll, err := geocodeNonZero(geocodeProvider, address)
+	if err == nil || geocodeFallback == nil {
+		return ll, *geocoderName, err
+	}
+	debugf("Geocoding %q with %s failed, trying %s: %v", address, *geocoderName, *geocoderFallbackName, err)
+	ll, fallbackErr := geocodeNonZero(geocodeFallback, address)
+	// Only wrap ErrGeocodeNotFound if both providers said so, otherwise the
+	// address would be cached as not found when one of them just failed.
+	primaryNotFound, fallbackNotFound := errors.Is(err, ErrGeocodeNotFound), errors.Is(fallbackErr, ErrGeocodeNotFound)
+	switch {
+	case fallbackErr == nil:
+		return ll, *geocoderFallbackName, nil
+	case primaryNotFound && !fallbackNotFound:
+		return latLong{}, "", fmt.Errorf("%v (%s: %w)", err, *geocoderFallbackName, fallbackErr)
+	case !primaryNotFound && fallbackNotFound:
+		return latLong{}, "", fmt.Errorf("%w (%s: %v)", err, *geocoderFallbackName, fallbackErr)
+	}
+	return latLong{}, "", fmt.Errorf("%w (%s: %w)", err, *geocoderFallbackName, fallbackErr)
+}
+
+// mapquestGeocoder geocodes with the MapQuest API.
+type mapquestGeocoder struct{}
+
+// mapquestError wraps err in the sentinel for its kind. The geocoder package
+// only returns untyped errors, so this goes by the status codes and messages
+// MapQuest uses.
+func mapquestError(err error) error {
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "quota") || strings.Contains(msg, "transaction limit"):
+		return fmt.Errorf("%w: %w", ErrGeocodeQuotaExceeded, err)
+	case strings.Contains(msg, "401") || strings.Contains(msg, "403") || strings.Contains(msg, "key"):
+		return fmt.Errorf("%w: %w", ErrGeocodeAuth, err)
+	case strings.Contains(msg, "429") || strings.Contains(msg, "limit"):
+		return fmt.Errorf("%w: %w", ErrGeocodeRateLimited, err)
+	case strings.Contains(msg, "not found") || strings.Contains(msg, "no results") || strings.Contains(msg, "index out of range"):
+		return fmt.Errorf("%w: %w", ErrGeocodeNotFound, err)
+	}
+	return err
+}
+
+func (mapquestGeocoder) Geocode(address string) (latLong, error) {
+	lat, lng, err := geocoder.Geocode(address)
+	if err != nil {
+		return latLong{}, mapquestError(err)
+	}
+	return latLong{Lat: lat, Long: lng}, nil
+}
+
+func (mapquestGeocoder) BatchGeocode(addresses []string) ([]latLong, []error) {
+	lls := make([]latLong, len(addresses))
+	errs := make([]error, len(addresses))
+	results, err := geocoder.BatchGeocode(addresses)
+	for i := range addresses {
+		switch {
+		case err != nil:
+			errs[i] = mapquestError(err)
+		case i >= len(results):
+			errs[i] = errors.New("missing from batch response")
+		default:
+			lls[i] = latLong{Lat: results[i].Lat, Long: results[i].Lng}
+		}
+	}
+	return lls, errs
+}
+
+// geocodeBatchSize is the most addresses sent in one batch, which is
+// MapQuest's limit.
+const geocodeBatchSize = 100
+
+// batchGeocode caches the coordinates of every uncached address of rs using
+// batch requests. Addresses that fail are left uncached so they're retried
+// one at a time.
+func (db *db) batchGeocode(g BatchGeocoder, rs []*restaurant) {
+	var addresses []string
+	seen := map[string]bool{}
+	for _, r := range rs {
+		address := joinAddressLines(geocodeAddress(r))
+		key := normalizeAddress(address)
+		if len(address) == 0 || seen[key] {
+			continue
+		}
+		seen[key] = true
+		if _, ok := db.cachedGeocode(address); !ok {
+			addresses = append(addresses, address)
+		}
+	}
+
+	failed := 0
+	for start := 0; start < len(addresses); start += geocodeBatchSize {
+		batch := addresses[start:min(start+geocodeBatchSize, len(addresses))]
+		infof("Batch geocoding %d addresses", len(batch))
+		geocodeStart := time.Now()
+		lls, errs := g.BatchGeocode(batch)
+		addPhaseTime(&geocodeTime, geocodeStart)
+		quotaExceeded := false
+		for i, address := range batch {
+			if errors.Is(errs[i], ErrGeocodeQuotaExceeded) {
+				quotaExceeded = true
+			}
+			if errs[i] == nil && nullIsland(lls[i]) {
+				errs[i] = ErrGeocodeNotFound
+			}
+			if errs[i] != nil {
+				debugf("Batch geocoding %q: %v", address, errs[i])
+				failed++
+				continue
+			}
+			db.cacheGeocode(address, lls[i], *geocoderName)
+		}
+		if quotaExceeded {
+			infof("Geocoder quota exceeded, stopping batch geocoding")
+			break
+		}
+	}
+	if failed > 0 {
+		infof("%d addresses failed to batch geocode and will be geocoded one at a time", failed)
+	}
+}
+
+type geocodeEntry struct {
+	latLong
+
+	CachedAt time.Time `json:",omitzero"`
+	// GeocodeSource is the provider that resolved the address. Entries
+	// cached before it was recorded came from MapQuest.
+	GeocodeSource string `json:",omitempty"`
+	// NotFound marks an address the geocoder couldn't find, so it isn't
+	// looked up on every run.
+	NotFound bool `json:",omitempty"`
+}
+
+// expired reports whether the entry is older than -geocode-ttl, or
+// -geocode-not-found-ttl for not found entries. Entries cached before
+// timestamps were recorded are always expired when a TTL is set.
+func (e geocodeEntry) expired() bool {
+	if e.NotFound {
+		return time.Since(e.CachedAt) > *notFoundTTL
+	}
+	return *geocodeTTL > 0 && time.Since(e.CachedAt) > *geocodeTTL
+}
+
+// nullIsland reports whether ll is at or next to (0, 0), which some
+// geocoders return instead of an error when they can't find an address.
+func nullIsland(ll latLong) bool {
+	return math.Abs(ll.Lat) < 1 && math.Abs(ll.Long) < 1
+}
+
+// normalizeAddress returns the key an address is cached under, so differences
+// in case, spacing and line breaks don't cause the same address to be geocoded
+// twice.
+func normalizeAddress(address string) string {
+	var parts []string
+	for _, part := range strings.FieldsFunc(address, func(r rune) bool {
+		return r == ',' || r == '\n'
+	}) {
+		part = strings.Join(strings.Fields(part), " ")
+		if len(part) > 0 {
+			parts = append(parts, strings.ToLower(part))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func loadGeocodeCache(file string) (map[string]geocodeEntry, error) {
+	cache := map[string]geocodeEntry{}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return cache, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(&cache); err != nil {
+		return nil, fmt.Errorf("%w: decoding %s: %w", ErrParse, file, err)
+	}
+	return cache, nil
+}
+
+// loadSharedGeocodeCache adds any entries from the -geocode-cache file that
+// aren't already in the DB's cache.
+func (db *db) loadSharedGeocodeCache() error {
+	if len(*geocodeCacheFile) == 0 {
+		return nil
+	}
+	shared, err := loadGeocodeCache(*geocodeCacheFile)
+	if err != nil {
+		return err
+	}
+	added := 0
+	for address, entry := range shared {
+		key := normalizeAddress(address)
+		if existing, ok := db.GeocodeCache[key]; !ok || existing.CachedAt.Before(entry.CachedAt) {
+			db.GeocodeCache[key] = entry
+			added++
+		}
+	}
+	infof("Loaded %d addresses from the shared geocode cache", added)
+	return nil
+}
+
+// saveSharedGeocodeCache merges the DB's cache into the -geocode-cache file.
+// The file is re-read first so entries written by other runs are kept.
+func (db *db) saveSharedGeocodeCache() error {
+	if len(*geocodeCacheFile) == 0 {
+		return nil
+	}
+	shared, err := loadGeocodeCache(*geocodeCacheFile)
+	if err != nil {
+		return err
+	}
+	for address, entry := range db.GeocodeCache {
+		key := normalizeAddress(address)
+		if existing, ok := shared[key]; !ok || !entry.CachedAt.Before(existing.CachedAt) {
+			shared[key] = entry
+		}
+	}
+
+	tmp := *geocodeCacheFile + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(shared); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, *geocodeCacheFile)
+}
+
+// staleCacheKeys returns the geocode cache keys that would be looked up under a
+// different key by the current normalizeAddress, mapped to that key. Those
+// entries are never hit, so the address is silently geocoded again.
+func (db *db) staleCacheKeys() map[string]string {
+	stale := map[string]string{}
+	for key := range db.GeocodeCache {
+		if normalized := normalizeAddress(key); normalized != key {
+			stale[key] = normalized
+		}
+	}
+	return stale
+}
+
+// migrateCacheKeys moves the entries under stale keys to their normalized
+// keys. Where both exist the newer entry is kept.
+func (db *db) migrateCacheKeys(stale map[string]string) {
+	for key, normalized := range stale {
+		entry := db.GeocodeCache[key]
+		delete(db.GeocodeCache, key)
+		if existing, ok := db.GeocodeCache[normalized]; ok && !existing.CachedAt.Before(entry.CachedAt) {
+			continue
+		}
+		db.GeocodeCache[normalized] = entry
+	}
+}
+
+// verifyGeocodeCache prints the stale keys of the DB's geocode cache, and with
+// -migrate-cache re-keys them so a normalization change doesn't quietly double
+// the geocoding done by the next run.
+func verifyGeocodeCache() error {
+	db := makeDB()
+	if err := db.load(); err != nil {
+		return err
+	}
+	stale := db.staleCacheKeys()
+	keys := make([]string, 0, len(stale))
+	for key := range stale {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("%q -> %q\n", key, stale[key])
+	}
+	infof("%d of %d geocode cache keys don't match the current normalization", len(stale), len(db.GeocodeCache))
+
+	if !*migrateCache || len(stale) == 0 {
+		return nil
+	}
+	db.migrateCacheKeys(stale)
+	infof("Migrated %d geocode cache keys", len(stale))
+	return db.save()
+}
+
+// pruneGeocodeCache removes the entries of the DB's geocode cache that no
+// restaurant's address, with or without the community hint, would look up.
+func pruneGeocodeCache() error {
+	db := makeDB()
+	if err := db.load(); err != nil {
+		return err
+	}
+	referenced := map[string]bool{}
+	for _, r := range db.Restaurants {
+		referenced[normalizeAddress(r.SiteAddress)] = true
+		referenced[normalizeAddress(communityAddress(r))] = true
+	}
+	pruned := 0
+	for key := range db.GeocodeCache {
+		if !referenced[normalizeAddress(key)] {
+			delete(db.GeocodeCache, key)
+			pruned++
+		}
+	}
+	infof("Pruned %d of %d geocode cache entries", pruned, pruned+len(db.GeocodeCache))
+	if pruned == 0 {
+		return nil
+	}
+	return db.save()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+// stubGeocoder returns the same result for every address and counts how many
+// it was asked for.
+type stubGeocoder struct {
+	ll    latLong
+	err   error
+	calls int
+}
+
+func (g *stubGeocoder) Geocode(address string) (latLong, error) {
+	g.calls++
+	return g.ll, g.err
+}
+
+func TestGeocodeNullIslandIsNotFound(t *testing.T) {
+	g := &stubGeocoder{}
+	setGlobal[Geocoder](t, &geocodeProvider, g)
+	setGlobal[Geocoder](t, &geocodeFallback, nil)
+
+	db := makeDB()
+	const address = "6138 Student Union Blvd, Vancouver, BC"
+	for i := 0; i < 2; i++ {
+		if _, err := db.geocode(address); !errors.Is(err, ErrGeocodeNotFound) {
+			t.Fatalf("geocode() error = %v, want %v", err, ErrGeocodeNotFound)
+		}
+	}
+	if g.calls != 1 {
+		t.Errorf("geocoder called %d times, want the second lookup to hit the not found cache", g.calls)
+	}
+	entry, ok := db.cachedGeocode(address)
+	if !ok || !entry.NotFound || entry.latLong != (latLong{}) {
+		t.Errorf("cached entry = %+v, %t, want a not found entry", entry, ok)
+	}
+}
+
+func TestGeocodeRestaurantsQuotaExceeded(t *testing.T) {
+	g := &stubGeocoder{err: fmt.Errorf("%w: daily limit reached", ErrGeocodeQuotaExceeded)}
+	setGlobal[Geocoder](t, &geocodeProvider, g)
+	setGlobal[Geocoder](t, &geocodeFallback, nil)
+	setGlobal(t, workersGeocode, 1)
+	setGlobal(t, quiet, true)
+
+	db := makeDB()
+	cached := latLong{Lat: 49.2666, Long: -123.25}
+	db.Restaurants = []*restaurant{
+		{ID: "1", Community: vancouverWestside, SiteAddress: "1 Main St"},
+		{ID: "2", Community: vancouverWestside, SiteAddress: "2 Main St"},
+		{ID: "3", Community: vancouverWestside, SiteAddress: "3 Main St"},
+		{ID: "4", Community: vancouverWestside, SiteAddress: "4 Main St", LatLong: cached},
+	}
+	before := atomic.LoadInt64(&errorCount)
+	if err := db.geocodeRestaurants(context.Background()); err != nil {
+		t.Fatalf("geocodeRestaurants() = %v, want the run to carry on", err)
+	}
+	if g.calls != 1 {
+		t.Errorf("geocoder called %d times, want geocoding to stop after the quota error", g.calls)
+	}
+	if n := atomic.LoadInt64(&errorCount) - before; n != 0 {
+		t.Errorf("%d errors logged, want the quota to only be warned about", n)
+	}
+	if db.Restaurants[3].LatLong != cached {
+		t.Errorf("cached coordinates changed to %v", db.Restaurants[3].LatLong)
+	}
+}
+
+func TestGeocodeFallbackNotFoundIsNotCached(t *testing.T) {
+	primary := &stubGeocoder{err: fmt.Errorf("%w: daily limit reached", ErrGeocodeQuotaExceeded)}
+	fallback := &stubGeocoder{err: ErrGeocodeNotFound}
+	setGlobal[Geocoder](t, &geocodeProvider, primary)
+	setGlobal[Geocoder](t, &geocodeFallback, fallback)
+	setGlobal(t, quiet, true)
+
+	db := makeDB()
+	const address = "6138 Student Union Blvd, Vancouver, BC"
+	_, err := db.geocode(address)
+	if !errors.Is(err, ErrGeocodeQuotaExceeded) || errors.Is(err, ErrGeocodeNotFound) {
+		t.Errorf("geocode() error = %v, want only %v", err, ErrGeocodeQuotaExceeded)
+	}
+	if entry, ok := db.cachedGeocode(address); ok {
+		t.Errorf("cached %+v, want nothing cached when the primary geocoder didn't say not found", entry)
+	}
+}
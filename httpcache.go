@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	httpCacheDir = flag.String("http-cache", "", "directory to cache raw HTTP responses in, so re-parsing doesn't require re-fetching")
+	httpCacheTTL = flag.Duration("http-cache-ttl", 0, "how long responses in -http-cache are served for, 0 serves them forever")
+)
+
+// httpCache is the transport's response cache, or nil if -http-cache isn't
+// set.
+var httpCache *cachingTransport
+
+// cachingTransport serves GET requests from responses saved on disk, keyed by
+// URL, and saves successful responses from next. Unlike the geocode cache it
+// stores the raw pages, so parser changes can be tried without hitting the
+// site again.
+type cachingTransport struct {
+	dir  string
+	ttl  time.Duration
+	next http.RoundTripper
+}
+
+func (t *cachingTransport) file(req *http.Request) string {
+	sum := sha256.Sum256([]byte(req.URL.String()))
+	return filepath.Join(t.dir, hex.EncodeToString(sum[:]))
+}
+
+// fresh reports whether req will be served from the cache. Requests with
+// Cache-Control: no-cache always go to the network.
+func (t *cachingTransport) fresh(req *http.Request) bool {
+	if t == nil || req.Method != "GET" || req.Header.Get("Cache-Control") == "no-cache" {
+		return false
+	}
+	info, err := os.Stat(t.file(req))
+	return err == nil && (t.ttl <= 0 || time.Since(info.ModTime()) < t.ttl)
+}
+
+// evict removes the cached response to req, if any.
+func (t *cachingTransport) evict(req *http.Request) {
+	if t == nil {
+		return
+	}
+	if err := os.Remove(t.file(req)); err != nil && !os.IsNotExist(err) {
+		logError(err)
+	}
+}
+
+func readCachedResponse(file string, req *http.Request) (*http.Response, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), req)
+}
+
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	file := t.file(req)
+	if t.fresh(req) {
+		resp, err := readCachedResponse(file, req)
+		if err == nil {
+			debugf("Cached: %s", req.URL)
+			return resp, nil
+		}
+		debugf("Ignoring unreadable cache entry for %s: %v", req.URL, err)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || req.Method != "GET" || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	// DumpResponse reads the body and replaces it with a copy, so the caller
+	// still gets the whole response.
+	data, err := httputil.DumpResponse(resp, true)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if err := os.MkdirAll(t.dir, 0755); err != nil {
+		logError(err)
+		return resp, nil
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		logError(err)
+		return resp, nil
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		logError(err)
+	}
+	return resp, nil
+}
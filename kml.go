@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+)
+
+type kmlPoint struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+type kmlPlacemark struct {
+	Name        string   `xml:"name"`
+	Description string   `xml:"description"`
+	Point       kmlPoint `xml:"Point"`
+}
+
+type kmlDocument struct {
+	Name       string         `xml:"name"`
+	Placemarks []kmlPlacemark `xml:"Placemark"`
+}
+
+type kml struct {
+	XMLName  xml.Name    `xml:"http://www.opengis.net/kml/2.2 kml"`
+	Document kmlDocument `xml:"Document"`
+}
+
+// writeKML writes rs as a KML document for Google Earth and My Maps, with a
+// placemark per restaurant. Restaurants that haven't been geocoded are
+// skipped.
+func writeKML(w io.Writer, rs []*restaurant) error {
+	doc := kml{Document: kmlDocument{Name: "Restaurants"}}
+	for _, r := range rs {
+		if r.LatLong == (latLong{}) {
+			continue
+		}
+		doc.Document.Placemarks = append(doc.Document.Placemarks, kmlPlacemark{
+			Name: r.Name,
+			Description: fmt.Sprintf("%d infractions in the past year, %d total\n%d outstanding critical, %d outstanding non-critical\n%s",
+				r.InfractionsPastYear, r.InfractionsTotal, r.OutstandingCriticalInfractions, r.OutstandingNonCriticalInfractions, r.MoreDetailsURL),
+			// KML coordinates are longitude first.
+			Point: kmlPoint{Coordinates: fmt.Sprintf("%f,%f,0", r.LatLong.Long, r.LatLong.Lat)},
+		})
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -1,84 +1,429 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/jasonwinn/geocoder"
+	"golang.org/x/net/html"
 )
 
 const (
 	restaurantsURL = "https://inspections.vcha.ca/FoodPremises/Table?SortMode=FacilityName&page=1&PageSize=100000"
 	dbFile         = "restaurants.json"
+)
+
+var (
+	borderLng       = flag.Float64("border-lng", -123.227883, "longitude of the UBC border; restaurants west of it are listed")
+	borderInclusive = flag.Bool("border-inclusive", false, "whether restaurants exactly on -border-lng are listed")
+)
+
+// insideBorder reports whether ll is west of the UBC border. A restaurant
+// exactly on the border is only inside with -border-inclusive.
+func insideBorder(ll latLong) bool {
+	if *borderInclusive {
+		return ll.Long <= *borderLng
+	}
+	return ll.Long < *borderLng
+}
+
+var (
+	quiet = flag.Bool("quiet", false, "whether to only log errors")
+	debug = flag.Bool("debug", false, "whether to log debugging details such as every response's status and size")
+)
+
+// infof logs progress information unless -quiet is set.
+func infof(format string, v ...interface{}) {
+	if *quiet {
+		return
+	}
+	log.Printf(format, v...)
+}
+
+var (
+	failOnError = flag.Bool("fail-on-error", false, "whether to exit with a non-zero status if any errors were logged during the run")
+
+	errorCount int64
+)
+
+// logError logs a non-fatal error and records it for -fail-on-error.
+func logError(err error) {
+	atomic.AddInt64(&errorCount, 1)
+	log.Println(err)
+}
 
-	borderLng = -123.227883
+var (
+	// ErrBlocked is returned when the inspections site refuses our requests,
+	// usually because we've been fetching too quickly.
+	ErrBlocked = errors.New("blocked by the inspections site")
+	// ErrGeocodeFailed is returned when an address couldn't be geocoded.
+	ErrGeocodeFailed = errors.New("geocode failed")
+	// ErrParse is returned when a page or saved value couldn't be parsed.
+	ErrParse = errors.New("parse error")
 )
 
+// debugf logs debugging details if -debug is set.
+func debugf(format string, v ...interface{}) {
+	if !*debug {
+		return
+	}
+	log.Printf(format, v...)
+}
+
 type latLong struct {
 	Lat, Long float64
 }
 
+// earthRadiusKm is the mean radius of the earth.
+const earthRadiusKm = 6371
+
+// haversine returns the great circle distance between a and b in kilometres.
+func haversine(a, b latLong) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(b.Lat - a.Lat)
+	dLong := toRad(b.Long - a.Long)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(toRad(a.Lat))*math.Cos(toRad(b.Lat))*math.Sin(dLong/2)*math.Sin(dLong/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
+
 type db struct {
 	Restaurants []*restaurant
 
-	GeocodeCache map[string]latLong
+	GeocodeCache map[string]geocodeEntry
+
+	// ListFetchedAt is when the restaurant list was last scraped.
+	ListFetchedAt time.Time `json:",omitzero"`
+	// UpdatedAt is when the last run finished and RunDuration how long it
+	// took.
+	UpdatedAt   time.Time     `json:",omitzero"`
+	RunDuration time.Duration `json:",omitempty"`
+
+	// mu guards GeocodeCache while geocoding concurrently and the
+	// restaurants while checkpointing during fetches.
+	mu sync.Mutex
 }
 
 func makeDB() *db {
 	return &db{
-		GeocodeCache: map[string]latLong{},
+		GeocodeCache: map[string]geocodeEntry{},
 	}
 }
 
+// load loads the DB from dbFile, leaving it empty if there isn't one yet.
 func (db *db) load() error {
-	f, err := os.OpenFile(dbFile, os.O_RDONLY, 0755)
-	if os.IsNotExist(err) {
-		log.Println("Can't load DB; not exist")
+	err := db.loadFrom(dbFile)
+	if errors.Is(err, os.ErrNotExist) {
+		infof("Can't load DB; not exist")
 		return nil
-	} else if err != nil {
-		return err
+	}
+	return err
+}
+
+func (db *db) loadFrom(file string) error {
+	f, err := os.OpenFile(file, os.O_RDONLY, 0755)
+	if err != nil {
+		return fmt.Errorf("loading DB: %w", err)
 	}
 	defer f.Close()
 
-	return json.NewDecoder(f).Decode(db)
+	if err := json.NewDecoder(f).Decode(db); err != nil {
+		return fmt.Errorf("%w: decoding %s: %w", ErrParse, file, err)
+	}
+	// Older DBs were saved before inspection types and follow-ups were
+	// parsed, and may have duplicate inspections.
+	for _, r := range db.Restaurants {
+		r.Inspections = dedupeInspections(r.Inspections)
+		for i := range r.Inspections {
+			r.Inspections[i].Type = parseInspectionType(r.Inspections[i].Reason)
+		}
+		linkFollowUps(r.Inspections)
+	}
+	return nil
 }
 
+var historyDir = flag.String("history-dir", "", "directory to also save a dated snapshot of the DB to")
+
 func (db *db) save() error {
-	f, err := os.OpenFile(dbFile, os.O_CREATE|os.O_WRONLY, 0755)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.saveTo(dbFile); err != nil {
+		return fmt.Errorf("saving DB: %w", err)
+	}
+	if len(*historyDir) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(*historyDir, 0755); err != nil {
+		return fmt.Errorf("saving DB history: %w", err)
+	}
+	return db.saveTo(filepath.Join(*historyDir, time.Now().Format("2006-01-02")+".json"))
+}
+
+// saveTo writes the DB to a temporary file and renames it over file, so a
+// crash mid-save can't leave a truncated DB behind.
+func (db *db) saveTo(file string) error {
+	tmp := file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
 	encoder := json.NewEncoder(f)
 	encoder.SetIndent("", "  ")
-	return encoder.Encode(db)
+	if err := encoder.Encode(db); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+type inspectionType int
+
+const (
+	inspectionOther inspectionType = iota
+	inspectionRoutine
+	inspectionFollowUp
+	inspectionComplaint
+)
+
+var inspectionTypeNames = map[inspectionType]string{
+	inspectionOther:     "Other",
+	inspectionRoutine:   "Routine",
+	inspectionFollowUp:  "Follow-Up",
+	inspectionComplaint: "Complaint",
+}
+
+func (t inspectionType) String() string {
+	return inspectionTypeNames[t]
+}
+
+func (t inspectionType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (t *inspectionType) UnmarshalText(text []byte) error {
+	for typ, name := range inspectionTypeNames {
+		if name == string(text) {
+			*t = typ
+			return nil
+		}
+	}
+	*t = inspectionOther
+	return nil
+}
+
+// parseInspectionType maps the free text inspection reason from the site to
+// an inspectionType. Follow-ups are checked first since the site labels them
+// "Routine Follow-up".
+func parseInspectionType(reason string) inspectionType {
+	reason = strings.ToLower(reason)
+	switch {
+	case strings.Contains(reason, "follow"):
+		return inspectionFollowUp
+	case strings.Contains(reason, "complaint"):
+		return inspectionComplaint
+	case strings.Contains(reason, "routine"):
+		return inspectionRoutine
+	default:
+		return inspectionOther
+	}
+}
+
+// trimmedInspections counts dropped inspections and their infractions.
+type trimmedInspections struct {
+	Inspections, Critical, NonCritical, Infractions int
 }
 
 type inspection struct {
 	Date                  string
 	Number                string
 	Reason                string
+	Type                  inspectionType
 	NonCritical, Critical int
+	// CorrectedCount is how many of the infractions were corrected during
+	// the inspection, when the details page says.
+	CorrectedCount int `json:",omitempty"`
+
+	// FollowsUp is the number of the inspection this one is a follow-up to,
+	// as referenced on the page. InferredFollowsUp is a guess at it for
+	// follow-ups that don't reference one.
+	FollowsUp         string `json:",omitempty"`
+	InferredFollowsUp string `json:",omitempty"`
+	// ReportURL links to the full inspection report.
+	ReportURL string `json:",omitempty"`
+}
+
+var (
+	excludeCorrected = flag.Bool("exclude-corrected", false, "whether to leave infractions corrected during the inspection out of the infraction totals")
+	excludeFollowUps = flag.Bool("exclude-followups", false, "whether to leave follow-up inspections, which often re-list the infractions being rechecked, out of the infraction totals")
+)
+
+// infractions returns how many infractions i counts towards the totals.
+func (i inspection) infractions() int {
+	if *excludeFollowUps && i.Type == inspectionFollowUp {
+		return 0
+	}
+	n := i.Critical + i.NonCritical
+	if *excludeCorrected {
+		n = max(n-i.CorrectedCount, 0)
+	}
+	return n
+}
+
+var timezone = flag.String("timezone", "America/Vancouver", "timezone inspection dates and the past year are computed in")
+
+// location is the -timezone location, set by setupTimezone.
+var location = time.UTC
+
+func setupTimezone() error {
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		return err
+	}
+	location = loc
+	return nil
+}
+
+const inspectionDateLayout = "02-Jan-2006"
+
+// parseInspectionDate parses an inspection date, which is normally absolute
+// but may be relative to today.
+func parseInspectionDate(date string) (time.Time, error) {
+	if t, ok := parseRelativeDate(date, time.Now()); ok {
+		return t, nil
+	}
+	return time.ParseInLocation(inspectionDateLayout, date, location)
+}
+
+var daysAgoRegexp = regexp.MustCompile(`^(\d+) days? ago$`)
+
+// parseRelativeDate parses "today", "yesterday" and "N days ago", optionally
+// prefixed with "Last inspected", as of now in -timezone.
+func parseRelativeDate(date string, now time.Time) (time.Time, bool) {
+	s := strings.Join(strings.Fields(strings.ToLower(date)), " ")
+	s = strings.TrimPrefix(s, "last inspected ")
+	now = now.In(location)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+	switch s {
+	case "today":
+		return today, true
+	case "yesterday":
+		return today.AddDate(0, 0, -1), true
+	}
+	m := daysAgoRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return time.Time{}, false
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return today.AddDate(0, 0, -n), true
+}
+
+var inspectionNumberRegexp = regexp.MustCompile(`\bINS\d+\b`)
+
+// linkFollowUps sets InferredFollowsUp on follow-up inspections that didn't
+// reference their original inspection on the page, using the most recent
+// earlier inspection that wasn't itself a follow-up.
+func linkFollowUps(is []inspection) {
+	for i := range is {
+		is[i].InferredFollowsUp = ""
+		if is[i].Type != inspectionFollowUp || len(is[i].FollowsUp) > 0 {
+			continue
+		}
+		date, err := parseInspectionDate(is[i].Date)
+		if err != nil {
+			continue
+		}
+		var best time.Time
+		for _, prior := range is {
+			if prior.Type == inspectionFollowUp {
+				continue
+			}
+			priorDate, err := parseInspectionDate(prior.Date)
+			if err != nil || priorDate.After(date) || priorDate.Before(best) {
+				continue
+			}
+			best = priorDate
+			is[i].InferredFollowsUp = prior.Number
+		}
+	}
+}
+
+// dedupeInspections removes repeated inspections, keyed by number or by date
+// for rows without one, keeping whichever copy has the most fields filled in.
+// Order is otherwise preserved.
+func dedupeInspections(is []inspection) []inspection {
+	key := func(i inspection) string {
+		if len(i.Number) > 0 {
+			return i.Number
+		}
+		return i.Date + "|" + i.Reason
+	}
+	richness := func(i inspection) int {
+		n := 0
+		for _, v := range []string{i.Date, i.Number, i.Reason, i.FollowsUp, i.ReportURL} {
+			if len(v) > 0 {
+				n++
+			}
+		}
+		if i.CorrectedCount > 0 {
+			n++
+		}
+		return n
+	}
+
+	index := map[string]int{}
+	out := is[:0:0]
+	for _, i := range is {
+		k := key(i)
+		if j, ok := index[k]; ok {
+			if richness(i) > richness(out[j]) {
+				out[j] = i
+			}
+			continue
+		}
+		index[k] = len(out)
+		out = append(out, i)
+	}
+	return out
 }
 
 type restaurant struct {
 	ID             string
 	Name           string
 	FacilityType   string
+	RiskCategory   string `json:",omitempty"`
 	Community      string
 	SiteAddress    string
 	PhoneNumber    string
@@ -87,11 +432,49 @@ type restaurant struct {
 	OutstandingNonCriticalInfractions, OutstandingCriticalInfractions int
 
 	Inspections []inspection
+	// Trimmed counts the older inspections -max-inspections dropped, so
+	// totals over the whole history still include them.
+	Trimmed trimmedInspections `json:",omitzero"`
+	// RawRows is the HTML of the inspection table rows as fetched, kept with
+	// -keep-raw so they can be re-parsed later without re-fetching.
+	RawRows []string `json:",omitempty"`
 
 	LatLong latLong
+	// LatLongFromDetails is set when LatLong came from the details page rather
+	// than the geocoder.
+	LatLongFromDetails bool `json:",omitempty"`
 
 	InfractionsPastYear int
 	InfractionsTotal    int
+	CleanStreak         int
+	// CriticalRatio is the fraction of all recorded infractions that were
+	// critical, or 0 if there are none.
+	CriticalRatio float64
+	// InfractionsByWindow is the number of infractions in each of the
+	// -windows, keyed by the window as given, e.g. "30d".
+	InfractionsByWindow map[string]int `json:",omitempty"`
+
+	// MedianInspectionGapDays is the median number of days between
+	// inspections and DaysSinceInspection how long it's been since the last
+	// one. Overdue is set when the latter is much longer than the former.
+	MedianInspectionGapDays int
+	DaysSinceInspection     int
+	Overdue                 bool
+
+	// DistanceKm is the distance from -center-lat and -center-lng when
+	// sorting by proximity.
+	DistanceKm float64 `json:",omitempty"`
+
+	// DetailHash is a hash of the parsed parts of the details page, used to
+	// skip re-parsing pages that haven't changed.
+	DetailHash string
+
+	// Removed is set when the restaurant is no longer in the scraped list,
+	// most likely because it closed.
+	Removed   bool      `json:",omitempty"`
+	RemovedAt time.Time `json:",omitzero"`
+	// AddedAt is when the restaurant first appeared in a scrape.
+	AddedAt time.Time `json:",omitzero"`
 }
 
 func resolveURL(base, rel string) (string, error) {
@@ -106,50 +489,280 @@ func resolveURL(base, rel string) (string, error) {
 	return baseURL.ResolveReference(relURL).String(), nil
 }
 
-func get(addr string) (*goquery.Document, error) {
-	req, err := http.NewRequest("GET", addr, nil)
+var (
+	maxIdleConns        = flag.Int("max-idle-conns", 100, "maximum number of idle HTTP connections to keep open")
+	maxIdleConnsPerHost = flag.Int("max-idle-conns-per-host", workers, "maximum number of idle HTTP connections to keep open per host")
+	idleConnTimeout     = flag.Duration("idle-conn-timeout", 90*time.Second, "how long to keep idle HTTP connections open")
+	disableKeepAlives   = flag.Bool("disable-keep-alives", false, "whether to use a new HTTP connection for every request")
+)
+
+var client = &http.Client{}
+
+// setupClient configures client's transport from flags. The defaults are
+// http.DefaultTransport's except for keeping an idle connection per worker.
+// If the server drops idle connections between slow requests, lower
+// -idle-conn-timeout or set -disable-keep-alives.
+func setupClient() {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = *maxIdleConns
+	transport.MaxIdleConnsPerHost = *maxIdleConnsPerHost
+	transport.IdleConnTimeout = *idleConnTimeout
+	transport.DisableKeepAlives = *disableKeepAlives
+	client.Transport = transport
+	if len(*httpCacheDir) > 0 {
+		httpCache = &cachingTransport{dir: *httpCacheDir, ttl: *httpCacheTTL, next: transport}
+		client.Transport = httpCache
+	}
+}
+
+var rate = flag.Duration("rate", 0, "minimum time between requests to each host, 0 is unlimited")
+
+var (
+	throttleMu sync.Mutex
+	// nextRequest is the earliest time the next request to each host can be
+	// made.
+	nextRequest = map[string]time.Time{}
+)
+
+// throttle blocks until -rate allows another request to host. Hosts are
+// limited independently so scraping one site doesn't slow down another.
+func throttle(host string) {
+	throttleEvery(host, *rate)
+}
+
+// bulkRate is the least time between requests for modes that request every
+// restaurant's URLs back to back, which would otherwise be unlimited by
+// default.
+const bulkRate = time.Second
+
+// throttleBulk blocks until another request to host can be made by such a
+// mode, at -rate or bulkRate, whichever is slower.
+func throttleBulk(host string) {
+	throttleEvery(host, max(*rate, bulkRate))
+}
+
+func throttleEvery(host string, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	throttleMu.Lock()
+	now := time.Now()
+	wait := max(nextRequest[host].Sub(now), 0)
+	nextRequest[host] = now.Add(wait + interval)
+	throttleMu.Unlock()
+	time.Sleep(wait)
+}
+
+// newRequest creates a request to the inspections site with the session
+// cookie set.
+func newRequest(method, addr string) (*http.Request, error) {
+	req, err := http.NewRequest(method, addr, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.AddCookie(&http.Cookie{
-		Name:  "ASP.NET_SessionId",
-		Value: "uiktkmxmg2fq3jw1pvwc4kgp",
+		Name:  sessionCookie,
+		Value: currentSession(),
 	})
-	log.Printf("Fetching: %s", addr)
-	resp, err := http.DefaultClient.Do(req)
+	return req, nil
+}
+
+// Fetcher fetches and parses pages from the inspections site. Tests can
+// supply one backed by saved pages instead of the network.
+type Fetcher interface {
+	Fetch(ctx context.Context, url string) (*goquery.Document, error)
+}
+
+// httpFetcher fetches pages with the configured client.
+type httpFetcher struct {
+	client *http.Client
+}
+
+var fetcher Fetcher = httpFetcher{client: client}
+
+// requestCount and bytesDownloaded count the pages fetched from the network,
+// rather than -http-cache, and their total size.
+var requestCount, bytesDownloaded int64
+
+var phaseTiming = flag.Bool("phase-timing", false, "whether to report the time spent fetching, parsing and geocoding at the end of the run, to find what's slowing it down")
+
+// fetchTime, parseTime and geocodeTime total the nanoseconds spent in each
+// phase of the run, summed across workers. Time spent waiting on the rate
+// limit isn't counted.
+var fetchTime, parseTime, geocodeTime int64
+
+func addPhaseTime(phase *int64, start time.Time) {
+	atomic.AddInt64(phase, int64(time.Since(start)))
+}
+
+// formatPhaseTime formats a phase's total to the second, or the millisecond
+// if it's shorter, e.g. "8m12s" or "412ms".
+func formatPhaseTime(phase *int64) string {
+	d := time.Duration(atomic.LoadInt64(phase))
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(time.Second).String()
+}
+
+// formatBytes formats n bytes in the largest unit that keeps it at least 1,
+// e.g. "14.2 MB".
+func formatBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
+
+// Fetch fetches addr, starting a new session and trying again once if the
+// session has expired.
+func (f httpFetcher) Fetch(ctx context.Context, addr string) (*goquery.Document, error) {
+	session := currentSession()
+	doc, err := f.fetch(ctx, addr)
+	if !errors.Is(err, ErrSessionExpired) {
+		return doc, err
+	}
+	if err := bootstrapSession(ctx, f.client, session); err != nil {
+		return nil, fmt.Errorf("fetching %s: %w: %w", addr, ErrSessionExpired, err)
+	}
+	return f.fetch(ctx, addr)
+}
+
+func (f httpFetcher) fetch(ctx context.Context, addr string) (*goquery.Document, error) {
+	req, err := newRequest("GET", addr)
 	if err != nil {
 		return nil, err
 	}
+	req = req.WithContext(ctx)
+	cached := httpCache.fresh(req)
+	if !cached {
+		throttle(req.URL.Host)
+	}
+	infof("Fetching: %s", addr)
+	start := time.Now()
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %w", addr, err)
+	}
 	defer resp.Body.Close()
 
-	doc, err := goquery.NewDocumentFromResponse(resp)
+	body, err := io.ReadAll(resp.Body)
+	addPhaseTime(&fetchTime, start)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("fetching %s: %w", addr, err)
+	}
+	debugf("%s %s: %d bytes", resp.Status, addr, len(body))
+	if !cached {
+		atomic.AddInt64(&requestCount, 1)
+		atomic.AddInt64(&bytesDownloaded, int64(len(body)))
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests:
+		return nil, fmt.Errorf("fetching %s: %s: %w", addr, resp.Status, ErrBlocked)
+	case resp.StatusCode >= 400:
+		return nil, fmt.Errorf("fetching %s: %s", addr, resp.Status)
+	case sessionExpired(resp, body):
+		// Don't serve the expired page from the cache next time.
+		httpCache.evict(req)
+		return nil, fmt.Errorf("fetching %s: %w", addr, ErrSessionExpired)
+	}
+
+	defer addPhaseTime(&parseTime, time.Now())
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrParse, addr, err)
 	}
 	return doc, nil
 }
 
-func getRestaurants() ([]*restaurant, error) {
-	doc, err := get(restaurantsURL)
+// parseCount parses a count cell. Cells often pad the number with
+// non-breaking spaces, which TrimSpace alone doesn't remove from the middle,
+// so all whitespace is dropped.
+func parseCount(text string) (int, error) {
+	return strconv.Atoi(strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, text))
+}
+
+// cellLines returns the non-empty lines of text in s, treating <br> and
+// block elements as line breaks, which Text() would otherwise run together.
+func cellLines(s *goquery.Selection) []string {
+	var b strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		switch {
+		case n.Type == html.TextNode:
+			b.WriteString(n.Data)
+		case n.Type == html.ElementNode && (n.Data == "br" || n.Data == "div" || n.Data == "p"):
+			b.WriteString("\n")
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	for _, n := range s.Nodes {
+		walk(n)
+	}
+
+	var lines []string
+	for _, line := range strings.Split(b.String(), "\n") {
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// joinAddressLines joins a multi-line address into the single line form the
+// geocoder expects, skipping blank lines.
+func joinAddressLines(address string) string {
+	var lines []string
+	for _, line := range strings.Split(address, "\n") {
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, ", ")
+}
+
+func getRestaurants(ctx context.Context, f Fetcher) ([]*restaurant, error) {
+	doc, err := f.Fetch(ctx, restaurantsURL)
 	if err != nil {
 		return nil, err
 	}
+	defer addPhaseTime(&parseTime, time.Now())
 
 	var restaurants []*restaurant
-	doc.Find("tr.hovereffect").Each(func(_ int, s *goquery.Selection) {
+	find(doc.Selection, "tr.hovereffect").Each(func(_ int, s *goquery.Selection) {
 		var r restaurant
-		r.Name = strings.TrimSpace(s.Find(".facilityName").Text())
-		r.FacilityType = strings.TrimSpace(s.Find(".facilityType").Text())
-		r.Community = strings.TrimSpace(s.Find(".community").Text())
-		r.SiteAddress = strings.TrimSpace(s.Find(".siteAddress").Text())
-		r.PhoneNumber = strings.TrimSpace(s.Find(".phoneNumber").Text())
+		r.Name = strings.TrimSpace(find(s, ".facilityName").Text())
+		r.FacilityType = strings.TrimSpace(find(s, ".facilityType").Text())
+		r.Community = strings.TrimSpace(find(s, ".community").Text())
+		r.SiteAddress = strings.Join(cellLines(find(s, ".siteAddress")), "\n")
+		r.PhoneNumber = strings.TrimSpace(find(s, ".phoneNumber").Text())
+		r.RiskCategory = parseRiskCategory(s.Find(".riskCategory, .hazardRating").Text())
 
 		onClick := strings.TrimSpace(s.AttrOr("onclick", ""))
-		url := strings.Split(onClick, "'")[1]
+		parts := strings.Split(onClick, "'")
+		if len(parts) < 2 {
+			logError(fmt.Errorf("%w: no details URL for %q in %q", ErrParse, r.Name, onClick))
+			return
+		}
+		url := parts[1]
 		r.ID = path.Base(url)
 		r.MoreDetailsURL, err = resolveURL(restaurantsURL, url)
 		if err != nil {
-			log.Println(err)
+			logError(fmt.Errorf("%w: details URL for %q: %w", ErrParse, r.Name, err))
 		}
 
 		restaurants = append(restaurants, &r)
@@ -157,205 +770,1476 @@ func getRestaurants() ([]*restaurant, error) {
 	return restaurants, nil
 }
 
-func (db *db) geocode(address string) (latLong, error) {
-	if len(address) == 0 {
-		return latLong{}, errors.New("address empty")
+func setNonEmpty(field *string, v string) {
+	if len(v) > 0 {
+		*field = v
 	}
+}
 
-	address = strings.Join(strings.Split(address, "\n"), ", ")
-	cached, ok := db.GeocodeCache[address]
-	if ok {
-		return cached, nil
+// updateListFields copies the fields that come from the list page from
+// scraped into r, leaving everything fetched or computed since alone. Blank
+// scraped fields don't overwrite ones filled in from the details page.
+func (r *restaurant) updateListFields(scraped *restaurant) {
+	// A relocated restaurant's coordinates are for its old address, so
+	// they're cleared to have it geocoded again.
+	if len(scraped.SiteAddress) > 0 && normalizeAddress(scraped.SiteAddress) != normalizeAddress(r.SiteAddress) {
+		infof("Address changed: %s (%s): %q -> %q", r.Name, r.ID, joinAddressLines(r.SiteAddress), joinAddressLines(scraped.SiteAddress))
+		r.LatLong = latLong{}
+		r.LatLongFromDetails = false
 	}
-
-	log.Printf("GEOCODE:\n%s", address)
-	lat, lng, err := geocoder.Geocode(address)
-	if err != nil {
-		return latLong{}, err
+	setNonEmpty(&r.Name, scraped.Name)
+	setNonEmpty(&r.FacilityType, scraped.FacilityType)
+	setNonEmpty(&r.RiskCategory, scraped.RiskCategory)
+	setNonEmpty(&r.Community, scraped.Community)
+	setNonEmpty(&r.SiteAddress, scraped.SiteAddress)
+	setNonEmpty(&r.PhoneNumber, scraped.PhoneNumber)
+	setNonEmpty(&r.MoreDetailsURL, scraped.MoreDetailsURL)
+	if r.Removed {
+		infof("Reappeared: %s (%s)", r.Name, r.ID)
+		r.Removed = false
+		r.RemovedAt = time.Time{}
 	}
-
-	cached = latLong{Lat: lat, Long: lng}
-	db.GeocodeCache[address] = cached
-
-	return cached, nil
 }
 
-const vancouverWestside = "Vancouver - Westside"
-
-func (db *db) geocodeRestaurants() error {
-	log.Printf("Geocoding %d restaurants...", len(db.Restaurants))
-	for i, r := range db.Restaurants {
-		if r.Community != vancouverWestside {
+// mergeRestaurants merges a freshly scraped list into the DB. Restaurants
+// already in the DB are matched by ID and only have their list fields updated,
+// so their inspections, coordinates and timestamps are kept. Restaurants that
+// are missing from the scrape are kept but marked as removed so their history
+// isn't lost, and new ones are marked as added.
+func (db *db) mergeRestaurants(scraped []*restaurant) {
+	now := time.Now()
+	existing := map[string]*restaurant{}
+	for _, r := range db.Restaurants {
+		existing[r.ID] = r
+	}
+	seen := map[string]bool{}
+	for i, r := range scraped {
+		seen[r.ID] = true
+		old, ok := existing[r.ID]
+		if !ok {
+			r.AddedAt = now
 			continue
 		}
-		log.Printf("Coding %d", i)
-		latLong, err := db.geocode(r.SiteAddress)
-		if err != nil {
-			return err
-		}
-		r.LatLong = latLong
+		old.updateListFields(r)
+		scraped[i] = old
 	}
-	return nil
-}
-
-func (db *db) getUBCRestaurants() []*restaurant {
-	var rs []*restaurant
 	for _, r := range db.Restaurants {
-		if r.LatLong.Long < borderLng {
-			rs = append(rs, r)
+		if seen[r.ID] {
+			continue
+		}
+		if !r.Removed {
+			infof("Removed: %s (%s)", r.Name, r.ID)
+			r.Removed = true
+			r.RemovedAt = now
 		}
+		scraped = append(scraped, r)
 	}
-	return rs
+	db.Restaurants = scraped
 }
 
-func computeInfractionsPastYear(rs []*restaurant) error {
-	yearAgo := time.Now().AddDate(-1, 0, 0)
+func addedSince(rs []*restaurant, since time.Time) []*restaurant {
+	var out []*restaurant
 	for _, r := range rs {
-		count := 0
-		total := 0
-		for _, i := range r.Inspections {
-			date, err := time.Parse("02-Jan-2006", i.Date)
-			if err != nil {
-				return err
-			}
-			if date.After(yearAgo) {
-				count += i.Critical + i.NonCritical
-			}
-			total += i.Critical + i.NonCritical
+		if !r.AddedAt.Before(since) {
+			out = append(out, r)
 		}
-		r.InfractionsPastYear = count
-		r.InfractionsTotal = total
 	}
-	return nil
+	return out
 }
 
-func printRestaurants(rs []*restaurant) {
-	fmt.Println("|Name|Infractions (Past Year)|Infractions (Total)|Outstanding Critical Infractions|Outstanding Non-CriticalInfractions||")
-	fmt.Println("|---|---|---|---|---|---|")
-	for _, r := range rs {
-		if len(r.Inspections) == 0 {
-			continue
-		}
+var listMaxAge = flag.Duration("list-max-age", 0, "how old the saved restaurant list can get before it's scraped again, 0 only scrapes it when empty or with -refetch")
 
-		fmt.Printf("|%s|%d|%d|%d|%d|[Details](%s)|\n", r.Name, r.InfractionsPastYear, r.InfractionsTotal, r.OutstandingCriticalInfractions, r.OutstandingNonCriticalInfractions, r.MoreDetailsURL)
-	}
+func (db *db) listStale() bool {
+	return *listMaxAge > 0 && time.Since(db.ListFetchedAt) > *listMaxAge
 }
 
-const workers = 16
-
-func fetchDetail(r *restaurant) error {
-	doc, err := get(r.MoreDetailsURL)
-	if err != nil {
-		return err
+func (db *db) geocode(address string) (latLong, error) {
+	if len(address) == 0 {
+		return latLong{}, fmt.Errorf("%w: address empty", ErrGeocodeFailed)
 	}
-	doc.Find("tr.nozebrastripes").Each(func(_ int, s *goquery.Selection) {
-		label := strings.TrimSpace(s.Find(".display-label").Text())
-		field := strings.TrimSpace(s.Find(".display-field").Text())
-		if label == "Outstanding Non-Critical Infractions" {
-			r.OutstandingNonCriticalInfractions, err = strconv.Atoi(field)
-			if err != nil {
-				log.Println(err)
-			}
-		} else if label == "Outstanding Critical Infractions" {
-			r.OutstandingCriticalInfractions, err = strconv.Atoi(field)
-			if err != nil {
-				log.Println(err)
-			}
-		}
-	})
 
-	var inspections []inspection
-	doc.Find("tr.hovereffect").Each(func(_ int, s *goquery.Selection) {
-		var i inspection
-		i.Date = strings.TrimSpace(s.Find(".inspectionDate").Text())
-		i.Number = strings.TrimSpace(s.Find(".inspectionNumber").Text())
-		i.Reason = strings.TrimSpace(s.Find(".inspectionType").Text())
-		i.Critical, err = strconv.Atoi(strings.TrimSpace(s.Find(".criticalInfractionsCount").Text()))
-		if err != nil {
-			log.Println(err)
+	address = joinAddressLines(address)
+	if cached, ok := db.cachedGeocode(address); ok {
+		if cached.NotFound {
+			return latLong{}, fmt.Errorf("%w: %q: %w (cached)", ErrGeocodeFailed, address, ErrGeocodeNotFound)
 		}
-		i.NonCritical, err = strconv.Atoi(strings.TrimSpace(s.Find(".nonCriticalInfractionsCount").Text()))
-		if err != nil {
-			log.Println(err)
+		return cached.latLong, nil
+	}
+
+	infof("GEOCODE:\n%s", address)
+	start := time.Now()
+	ll, source, err := geocodeWithFallback(address)
+	addPhaseTime(&geocodeTime, start)
+	if err != nil {
+		if errors.Is(err, ErrGeocodeNotFound) {
+			db.cacheNotFound(address)
 		}
-		inspections = append(inspections, i)
-	})
-	r.Inspections = inspections
+		return latLong{}, fmt.Errorf("%w: %q: %w", ErrGeocodeFailed, address, err)
+	}
+	db.cacheGeocode(address, ll, source)
+	return ll, nil
+}
 
-	return nil
+// cachedGeocode returns the unexpired cache entry for address, which must
+// already have had its lines joined.
+func (db *db) cachedGeocode(address string) (geocodeEntry, bool) {
+	key := normalizeAddress(address)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// Entries cached before addresses were normalized are keyed by the raw
+	// address.
+	if cached, ok := db.GeocodeCache[address]; ok && address != key {
+		delete(db.GeocodeCache, address)
+		if _, ok := db.GeocodeCache[key]; !ok {
+			db.GeocodeCache[key] = cached
+		}
+	}
+	cached, ok := db.GeocodeCache[key]
+	// Null island results cached before they were treated as not found
+	// are bogus.
+	if !ok || cached.expired() || (!cached.NotFound && nullIsland(cached.latLong)) {
+		return geocodeEntry{}, false
+	}
+	return cached, true
 }
 
-func fetchDetails(rs []*restaurant) {
-	rsChan := make(chan *restaurant, workers)
+// cacheNotFound records that address couldn't be found so it isn't looked up
+// again until -geocode-not-found-ttl passes.
+func (db *db) cacheNotFound(address string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.GeocodeCache[normalizeAddress(address)] = geocodeEntry{
+		CachedAt: time.Now(),
+		NotFound: true,
+	}
+}
+
+func (db *db) cacheGeocode(address string, ll latLong, source string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.GeocodeCache[normalizeAddress(address)] = geocodeEntry{
+		latLong:       ll,
+		CachedAt:      time.Now(),
+		GeocodeSource: source,
+	}
+}
+
+const vancouverWestside = "Vancouver - Westside"
+
+var (
+	geocodeWithCommunity = flag.Bool("geocode-with-community", false, "whether to include the community as a locality hint when geocoding")
+	regeocode            = flag.Bool("regeocode", false, "whether to geocode restaurants that already have coordinates")
+	failOnGeocodeError   = flag.Bool("fail-on-geocode-error", false, "whether to stop the run when an address can't be geocoded")
+)
+
+// geocodeAddress returns the address to geocode for r. With
+// -geocode-with-community the community is inserted after the street line, so
+// "Vancouver - Westside" becomes a "Westside, Vancouver" locality hint.
+func geocodeAddress(r *restaurant) string {
+	if !*geocodeWithCommunity {
+		return r.SiteAddress
+	}
+	return communityAddress(r)
+}
+
+func communityAddress(r *restaurant) string {
+	if len(r.Community) == 0 {
+		return r.SiteAddress
+	}
+	parts := strings.Split(r.Community, " - ")
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	lines := strings.SplitN(r.SiteAddress, "\n", 2)
+	lines = append(lines[:1], append([]string{strings.Join(parts, ", ")}, lines[1:]...)...)
+	return strings.Join(lines, "\n")
+}
+
+// logAddressStats logs how many distinct addresses the selected communities
+// have and how many of those are already cached, which is the most geocoding
+// a run can do.
+func (db *db) logAddressStats() {
+	total := 0
+	unique := map[string]bool{}
+	cached := 0
+	for _, r := range db.Restaurants {
+		if !inSelectedCommunity(r) || len(r.SiteAddress) == 0 {
+			continue
+		}
+		total++
+		address := geocodeAddress(r)
+		key := normalizeAddress(address)
+		if unique[key] {
+			continue
+		}
+		unique[key] = true
+		_, ok := db.GeocodeCache[key]
+		if !ok {
+			_, ok = db.GeocodeCache[joinAddressLines(address)]
+		}
+		if ok {
+			cached++
+		}
+	}
+	infof("%d restaurants have %d unique addresses, %d of which are cached", total, len(unique), cached)
+}
+
+func (db *db) geocodeRestaurants(ctx context.Context) error {
+	if err := db.loadSharedGeocodeCache(); err != nil {
+		return err
+	}
+	defer func() {
+		if err := db.saveSharedGeocodeCache(); err != nil {
+			logError(err)
+		}
+	}()
+
+	db.logAddressStats()
+
+	var todo []*restaurant
+	for _, r := range db.Restaurants {
+		if !inSelectedCommunity(r) {
+			continue
+		}
+		// With a TTL every restaurant is checked so expired entries are
+		// refreshed.
+		if r.LatLong != (latLong{}) && !*refetch && !*regeocode && *geocodeTTL == 0 {
+			continue
+		}
+		if r.LatLongFromDetails {
+			continue
+		}
+		todo = append(todo, r)
+	}
+	infof("Geocoding %d restaurants...", len(todo))
+	if batcher, ok := geocodeProvider.(BatchGeocoder); ok {
+		db.batchGeocode(batcher, todo)
+	}
+	bar := newProgress("Geocoding", len(todo))
+	defer bar.finish()
+
+	var (
+		mu                sync.Mutex
+		firstErr          error
+		quotaExhausted    bool
+		errorKinds        = map[string]int{}
+		movedIn, movedOut int
+	)
+	rsChan := make(chan *restaurant, *workersGeocode)
 	var wg sync.WaitGroup
-	for i := 0; i < workers; i++ {
+	for i := 0; i < *workersGeocode; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 
 			for r := range rsChan {
-				if err := fetchDetail(r); err != nil {
-					log.Println(err)
-					return
+				// Addresses queued before the quota ran out aren't tried.
+				mu.Lock()
+				skip := quotaExhausted
+				mu.Unlock()
+				if skip {
+					continue
 				}
+				latLong, err := db.geocode(geocodeAddress(r))
+				bar.increment()
+				mu.Lock()
+				if err != nil {
+					errorKinds[geocodeErrorKind(err)]++
+					// Geocoding can pick up where it left off once the
+					// quota resets, so the rest of the run carries on
+					// with the cached coordinates.
+					if errors.Is(err, ErrGeocodeQuotaExceeded) {
+						if !quotaExhausted {
+							log.Printf("Geocoder quota exhausted, skipping the remaining addresses this run: %v", err)
+						}
+						quotaExhausted = true
+						mu.Unlock()
+						continue
+					}
+					// A geocoder outage shouldn't stop restaurants with
+					// cached coordinates from being listed.
+					if !*failOnGeocodeError {
+						logError(err)
+					} else if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					continue
+				}
+				wasInside := insideBorder(r.LatLong)
+				r.LatLong = latLong
+				if isInside := insideBorder(r.LatLong); isInside && !wasInside {
+					movedIn++
+				} else if !isInside && wasInside {
+					movedOut++
+				}
+				mu.Unlock()
 			}
 		}()
 	}
+	for i, r := range todo {
+		mu.Lock()
+		stop := firstErr != nil || quotaExhausted
+		mu.Unlock()
+		if stop {
+			break
+		}
+		if ctx.Err() != nil {
+			infof("Stopped geocoding: %v", ctx.Err())
+			break
+		}
+		infof("Coding %d", i)
+		rsChan <- r
+	}
+	close(rsChan)
+	wg.Wait()
+
+	infof("Geocoding moved %d restaurants inside the border and %d outside", movedIn, movedOut)
+	if len(errorKinds) > 0 {
+		kinds := make([]string, 0, len(errorKinds))
+		for kind := range errorKinds {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		for i, kind := range kinds {
+			kinds[i] = fmt.Sprintf("%d %s", errorKinds[kind], kind)
+		}
+		log.Printf("Geocode errors: %s", strings.Join(kinds, ", "))
+	}
+	return firstErr
+}
+
+var (
+	community = flag.String("community", vancouverWestside, "comma separated list of communities to geocode and analyze")
+	ubcOnly   = flag.Bool("ubc", true, "whether to only list restaurants west of the UBC border rather than all restaurants in the communities")
+)
+
+func selectedCommunities() []string {
+	var cs []string
+	for _, c := range strings.Split(*community, ",") {
+		if c = strings.TrimSpace(c); len(c) > 0 {
+			cs = append(cs, c)
+		}
+	}
+	return cs
+}
+
+func inSelectedCommunity(r *restaurant) bool {
+	for _, c := range selectedCommunities() {
+		if r.Community == c {
+			return true
+		}
+	}
+	return false
+}
+
+// getSelectedRestaurants returns the restaurants to list: those on the UBC side
+// of the border, or with -ubc=false every restaurant in the selected
+// communities.
+func (db *db) getSelectedRestaurants() []*restaurant {
+	if *ubcOnly {
+		return db.getUBCRestaurants()
+	}
+	var rs []*restaurant
+	for _, r := range db.Restaurants {
+		if inSelectedCommunity(r) {
+			rs = append(rs, r)
+		}
+	}
+	return rs
+}
+
+// getUBCRestaurants returns the geocoded restaurants west of the UBC border.
+func (db *db) getUBCRestaurants() []*restaurant {
+	var rs []*restaurant
+	for _, r := range db.Restaurants {
+		if r.LatLong != (latLong{}) && insideBorder(r.LatLong) {
+			rs = append(rs, r)
+		}
+	}
+	return rs
+}
+
+// getFetchRestaurants returns the restaurants to fetch the details of: the
+// selected restaurants rs and, since which side of the border they're on
+// isn't known yet, the ones in the selected communities that haven't been
+// geocoded, such as with -fetch-only or after geocoding failed. That way
+// fetching details doesn't depend on geocoding.
+func (db *db) getFetchRestaurants(rs []*restaurant) []*restaurant {
+	if !*ubcOnly {
+		return rs
+	}
+	out := append([]*restaurant(nil), rs...)
+	ungeocoded := 0
+	for _, r := range db.Restaurants {
+		if r.LatLong == (latLong{}) && inSelectedCommunity(r) {
+			out = append(out, r)
+			ungeocoded++
+		}
+	}
+	if ungeocoded > 0 {
+		infof("Also fetching %d restaurants that haven't been geocoded", ungeocoded)
+	}
+	return out
+}
+
+var (
+	outstandingCriticalOnly = flag.Bool("outstanding-critical-only", false, "whether to only list restaurants with outstanding critical infractions")
+	riskFilter              = flag.String("risk", "", "comma separated risk categories to list: high, moderate, low")
+	minInspections          = flag.Int("min-inspections", 0, "minimum number of inspections a restaurant needs to be listed")
+	includeRemoved          = flag.Bool("include-removed", false, "whether to list restaurants that are no longer in the scraped list, with a status column marking them")
+)
+
+// parseRiskCategory normalizes a hazard rating or risk category from the site
+// to High, Moderate or Low. Anything else is kept as is.
+func parseRiskCategory(s string) string {
+	s = strings.TrimSpace(s)
+	lower := strings.ToLower(s)
+	switch {
+	case strings.Contains(lower, "high"):
+		return "High"
+	case strings.Contains(lower, "moderate"), strings.Contains(lower, "medium"):
+		return "Moderate"
+	case strings.Contains(lower, "low"):
+		return "Low"
+	default:
+		return s
+	}
+}
+
+// filterRestaurants returns the restaurants in rs that pass the output filters.
+func filterRestaurants(rs []*restaurant) []*restaurant {
+	risks := map[string]bool{}
+	for _, risk := range strings.Split(*riskFilter, ",") {
+		if risk = parseRiskCategory(risk); len(risk) > 0 {
+			risks[risk] = true
+		}
+	}
+
+	var out []*restaurant
 	for _, r := range rs {
-		if !(len(r.Inspections) == 0 || *refetch) {
+		if r.Removed && !*includeRemoved {
 			continue
 		}
-		rsChan <- r
+		if *outstandingCriticalOnly && r.OutstandingCriticalInfractions == 0 {
+			continue
+		}
+		if len(risks) > 0 && !risks[r.RiskCategory] {
+			continue
+		}
+		if len(r.Inspections)+r.Trimmed.Inspections < *minInspections {
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+var windows = flag.String("windows", "", "comma separated windows to also count infractions over, each a number of days like 30d, shown as extra columns")
+
+type window struct {
+	Name string
+	Days int
+}
+
+// infractionWindows are the parsed -windows.
+var infractionWindows []window
+
+// setupWindows parses -windows.
+func setupWindows() error {
+	for _, name := range strings.Split(*windows, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		days, err := strconv.Atoi(strings.TrimSuffix(name, "d"))
+		if err != nil || !strings.HasSuffix(name, "d") || days <= 0 {
+			return fmt.Errorf("invalid window %q, want a number of days like 30d", name)
+		}
+		infractionWindows = append(infractionWindows, window{Name: name, Days: days})
+	}
+	return nil
+}
+
+func computeInfractionsPastYear(rs []*restaurant) error {
+	return computeInfractionsAsOf(rs, time.Now())
+}
+
+// computeInfractionsAsOf computes the infraction metrics as of now. Inspection
+// dates have no time of day, so an inspection on the same date a year ago is
+// within the past year. Inspections dated after now only count towards the
+// total.
+func computeInfractionsAsOf(rs []*restaurant, now time.Time) error {
+	now = now.In(location)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+	yearAgo := today.AddDate(-1, 0, 0)
+	for _, r := range rs {
+		count := 0
+		total := r.Trimmed.Infractions
+		critical, all := 0, 0
+		var byWindow map[string]int
+		if len(infractionWindows) > 0 {
+			byWindow = map[string]int{}
+			for _, w := range infractionWindows {
+				byWindow[w.Name] = 0
+			}
+		}
+		for _, i := range r.Inspections {
+			critical += i.Critical
+			all += i.Critical + i.NonCritical
+			date, err := parseInspectionDate(i.Date)
+			if err != nil {
+				return fmt.Errorf("%w: %s inspection %s date: %w", ErrParse, r.ID, i.Number, err)
+			}
+			if !date.Before(yearAgo) && !date.After(today) {
+				count += i.infractions()
+			}
+			for _, w := range infractionWindows {
+				if !date.Before(today.AddDate(0, 0, -w.Days)) && !date.After(today) {
+					byWindow[w.Name] += i.infractions()
+				}
+			}
+			total += i.infractions()
+		}
+		r.InfractionsPastYear = count
+		r.InfractionsTotal = total
+		r.InfractionsByWindow = byWindow
+		r.CriticalRatio = 0
+		if all > 0 {
+			r.CriticalRatio = float64(critical) / float64(all)
+		}
+		r.CleanStreak = cleanStreak(r)
+		r.MedianInspectionGapDays, r.DaysSinceInspection = inspectionGaps(r, today)
+		r.Overdue = overdue(r)
+	}
+	return nil
+}
+
+var overdueFactor = flag.Float64("overdue-factor", 2, "how many times longer than the median gap between inspections a restaurant must go uninspected to be overdue")
+
+// overdue reports whether r has gone uninspected for -overdue-factor times
+// its median gap between inspections.
+func overdue(r *restaurant) bool {
+	return r.MedianInspectionGapDays > 0 && float64(r.DaysSinceInspection) > *overdueFactor*float64(r.MedianInspectionGapDays)
+}
+
+// inspectionGaps returns the median number of days between r's inspections,
+// or 0 if it has fewer than two, and the number of days from its last
+// inspection to today. Follow-ups come soon after the inspection they recheck,
+// so they're left out rather than shortening the usual cadence.
+func inspectionGaps(r *restaurant, today time.Time) (median, since int) {
+	var dates []time.Time
+	for _, i := range r.Inspections {
+		if i.Type == inspectionFollowUp {
+			continue
+		}
+		date, err := parseInspectionDate(i.Date)
+		if err != nil {
+			continue
+		}
+		dates = append(dates, date)
+	}
+	if len(dates) == 0 {
+		return 0, 0
+	}
+	sort.Slice(dates, func(i, j int) bool {
+		return dates[i].Before(dates[j])
+	})
+	since = days(today.Sub(dates[len(dates)-1]))
+
+	var gaps []int
+	for i := 1; i < len(dates); i++ {
+		gaps = append(gaps, days(dates[i].Sub(dates[i-1])))
+	}
+	if len(gaps) == 0 {
+		return 0, since
+	}
+	sort.Ints(gaps)
+	if len(gaps)%2 == 1 {
+		median = gaps[len(gaps)/2]
+	} else {
+		median = (gaps[len(gaps)/2-1] + gaps[len(gaps)/2]) / 2
+	}
+	return median, since
+}
+
+func days(d time.Duration) int {
+	return int((d + 12*time.Hour) / (24 * time.Hour))
+}
+
+// cleanStreak returns how many of r's most recent inspections in a row had no
+// critical infractions.
+func cleanStreak(r *restaurant) int {
+	type dated struct {
+		date     time.Time
+		critical int
+	}
+	var is []dated
+	for _, i := range r.Inspections {
+		date, err := parseInspectionDate(i.Date)
+		if err != nil {
+			continue
+		}
+		is = append(is, dated{date: date, critical: i.Critical})
+	}
+	sort.Slice(is, func(i, j int) bool {
+		return is[i].date.After(is[j].date)
+	})
+
+	streak := 0
+	for _, i := range is {
+		if i.critical > 0 {
+			break
+		}
+		streak++
+	}
+	return streak
+}
+
+var maxInspections = flag.Int("max-inspections", 0, "number of most recent inspections to keep per restaurant in the DB, 0 keeps all")
+
+// trimInspections sorts each restaurant's inspections newest first and drops
+// all but the n most recent, counting the dropped ones in Trimmed.
+// Inspections with unparseable dates sort last.
+func trimInspections(rs []*restaurant, n int) {
+	for _, r := range rs {
+		sort.SliceStable(r.Inspections, func(i, j int) bool {
+			a, errA := parseInspectionDate(r.Inspections[i].Date)
+			b, errB := parseInspectionDate(r.Inspections[j].Date)
+			if errA != nil || errB != nil {
+				return errB != nil && errA == nil
+			}
+			return a.After(b)
+		})
+		if len(r.Inspections) <= n {
+			continue
+		}
+		for _, i := range r.Inspections[n:] {
+			r.Trimmed.Inspections++
+			r.Trimmed.Critical += i.Critical
+			r.Trimmed.NonCritical += i.NonCritical
+			r.Trimmed.Infractions += i.infractions()
+		}
+		r.Inspections = r.Inspections[:n]
+	}
+}
+
+var markdownEscaper = strings.NewReplacer("|", "\\|", "\r\n", " ", "\n", " ", "\r", " ")
+
+// escapeMarkdown makes s safe to use inside a markdown table cell.
+func escapeMarkdown(s string) string {
+	return markdownEscaper.Replace(s)
+}
+
+var (
+	severityHighCritical   = flag.Int("severity-high-critical", 1, "outstanding critical infractions that make a restaurant's severity High")
+	severityHighPastYear   = flag.Int("severity-high-past-year", 10, "infractions in the past year that make a restaurant's severity High")
+	severityMediumPastYear = flag.Int("severity-medium-past-year", 3, "infractions in the past year that make a restaurant's severity Medium")
+)
+
+// severity labels r as High, Medium or Low from its outstanding critical
+// infractions and recent infractions, so the table can be scanned at a glance.
+// Any outstanding non-critical infraction makes it at least Medium.
+func severity(r *restaurant) string {
+	switch {
+	case r.OutstandingCriticalInfractions >= *severityHighCritical || r.InfractionsPastYear >= *severityHighPastYear:
+		return "High"
+	case r.OutstandingNonCriticalInfractions > 0 || r.InfractionsPastYear >= *severityMediumPastYear:
+		return "Medium"
+	default:
+		return "Low"
+	}
+}
+
+func writeMarkdown(w io.Writer, rs []*restaurant) error {
+	extra, err := selectedColumns()
+	if err != nil {
+		return err
+	}
+
+	header := "|Severity|Name|Infractions (Past Year)|Infractions (Total)|Outstanding Critical Infractions|Outstanding Non-CriticalInfractions|"
+	divider := "|---|---|---|---|---|---|"
+	for _, c := range extra {
+		header += escapeMarkdown(c.Header) + "|"
+		divider += "---|"
+	}
+	fmt.Fprintln(w, header+"|")
+	fmt.Fprintln(w, divider+"---|")
+	for _, r := range rs {
+		if len(r.Inspections) == 0 {
+			continue
+		}
+
+		row := fmt.Sprintf("|%s|%s|%d|%d|%d|%d|", severity(r), escapeMarkdown(r.Name), r.InfractionsPastYear, r.InfractionsTotal, r.OutstandingCriticalInfractions, r.OutstandingNonCriticalInfractions)
+		for _, c := range extra {
+			row += escapeMarkdown(c.Value(r)) + "|"
+		}
+		row += fmt.Sprintf("[Details](%s)|", escapeMarkdown(r.MoreDetailsURL))
+		if _, err := fmt.Fprintln(w, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// workers is the default number of details pages fetched at once.
+const workers = 16
+
+var (
+	workersFetch   = flag.Int("workers-fetch", workers, "number of details pages to fetch at once")
+	workersGeocode = flag.Int("workers-geocode", 1, "number of addresses to geocode at once")
+)
+
+// detailHash hashes the rows of a details page that fetchDetail parses.
+func detailHash(doc *goquery.Document) (string, error) {
+	h := sha256.New()
+	var err error
+	doc.Find("tr.nozebrastripes, tr.hovereffect").EachWithBreak(func(_ int, s *goquery.Selection) bool {
+		var html string
+		html, err = goquery.OuterHtml(s)
+		if err != nil {
+			return false
+		}
+		io.WriteString(h, html)
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+var (
+	latLongAttrs = [][2]string{
+		{"data-lat", "data-lng"},
+		{"data-lat", "data-lon"},
+		{"data-latitude", "data-longitude"},
+	}
+	latRegexp     = regexp.MustCompile(`(?i)\blat(?:itude)?["']?\s*[:=]\s*["']?(-?\d+\.\d+)`)
+	lngRegexp     = regexp.MustCompile(`(?i)\b(?:lng|lon|longitude)["']?\s*[:=]\s*["']?(-?\d+\.\d+)`)
+	mapLinkRegexp = regexp.MustCompile(`(?:[?&]q=|@)(-?\d+\.\d+),\s*(-?\d+\.\d+)`)
+)
+
+func parseLatLong(lat, lng string) (latLong, bool) {
+	latF, err := strconv.ParseFloat(strings.TrimSpace(lat), 64)
+	if err != nil {
+		return latLong{}, false
+	}
+	lngF, err := strconv.ParseFloat(strings.TrimSpace(lng), 64)
+	if err != nil {
+		return latLong{}, false
+	}
+	if latF < -90 || latF > 90 || lngF < -180 || lngF > 180 || (latF == 0 && lngF == 0) {
+		return latLong{}, false
+	}
+	return latLong{Lat: latF, Long: lngF}, true
+}
+
+// detailLatLong looks for map coordinates embedded in a details page, in data
+// attributes, map scripts or map links.
+func detailLatLong(doc *goquery.Document) (latLong, bool) {
+	for _, attrs := range latLongAttrs {
+		s := doc.Find("[" + attrs[0] + "][" + attrs[1] + "]").First()
+		if s.Length() == 0 {
+			continue
+		}
+		if ll, ok := parseLatLong(s.AttrOr(attrs[0], ""), s.AttrOr(attrs[1], "")); ok {
+			return ll, true
+		}
+	}
+
+	var found latLong
+	ok := false
+	doc.Find("script").EachWithBreak(func(_ int, s *goquery.Selection) bool {
+		text := s.Text()
+		lat := latRegexp.FindStringSubmatch(text)
+		lng := lngRegexp.FindStringSubmatch(text)
+		if lat == nil || lng == nil {
+			return true
+		}
+		found, ok = parseLatLong(lat[1], lng[1])
+		return !ok
+	})
+	if ok {
+		return found, true
+	}
+
+	doc.Find("a[href], iframe[src]").EachWithBreak(func(_ int, s *goquery.Selection) bool {
+		m := mapLinkRegexp.FindStringSubmatch(s.AttrOr("href", s.AttrOr("src", "")))
+		if m == nil {
+			return true
+		}
+		found, ok = parseLatLong(m[1], m[2])
+		return !ok
+	})
+	return found, ok
+}
+
+// detailListField returns the field of r that a details page summary row with
+// label duplicates from the list page, or nil if it isn't one. The details page
+// is used to fill in fields the list page left blank.
+func detailListField(r *restaurant, label string) *string {
+	switch strings.ToLower(strings.TrimSuffix(label, ":")) {
+	case "name", "facility name":
+		return &r.Name
+	case "facility type", "type":
+		return &r.FacilityType
+	case "community":
+		return &r.Community
+	case "address", "site address":
+		return &r.SiteAddress
+	case "phone", "phone number":
+		return &r.PhoneNumber
+	}
+	return nil
+}
+
+var keepRaw = flag.Bool("keep-raw", false, "whether to also save the raw HTML of each restaurant's inspection rows in the DB")
+
+func fetchDetail(ctx context.Context, f Fetcher, r *restaurant) error {
+	doc, err := f.Fetch(ctx, r.MoreDetailsURL)
+	if err != nil {
+		return err
+	}
+	defer addPhaseTime(&parseTime, time.Now())
+	// Coordinates are picked up before the unchanged check so restaurants
+	// fetched before they were parsed still get them.
+	if ll, ok := detailLatLong(doc); ok {
+		r.LatLong = ll
+		r.LatLongFromDetails = true
+	}
+	hash, err := detailHash(doc)
+	if err != nil {
+		return fmt.Errorf("%w: hashing %s: %w", ErrParse, r.MoreDetailsURL, err)
+	}
+	// Pages are re-parsed when -keep-raw is newly set so their rows are
+	// saved.
+	if hash == r.DetailHash && !(*keepRaw && len(r.RawRows) == 0) {
+		infof("Unchanged: %s", r.MoreDetailsURL)
+		return nil
+	}
+
+	// Parse errors are logged and the rest of the page still parsed, but
+	// the restaurant is reported as failed at the end.
+	parseErrors := 0
+	parseError := func(err error) {
+		logError(err)
+		parseErrors++
+	}
+
+	// The summary's total number of inspections, if it states one, is
+	// checked against the rows parsed below.
+	statedInspections := -1
+	find(doc.Selection, "tr.nozebrastripes").Each(func(_ int, s *goquery.Selection) {
+		label := strings.TrimSpace(find(s, ".display-label").Text())
+		field := strings.TrimSpace(find(s, ".display-field").Text())
+		if dst := detailListField(r, label); dst != nil {
+			fillEmpty(dst, strings.Join(cellLines(find(s, ".display-field")), "\n"))
+		} else if label == "Outstanding Non-Critical Infractions" {
+			r.OutstandingNonCriticalInfractions, err = parseCount(field)
+			if err != nil {
+				parseError(fmt.Errorf("%w: %s outstanding non-critical infractions: %w", ErrParse, r.ID, err))
+			}
+		} else if label == "Outstanding Critical Infractions" {
+			r.OutstandingCriticalInfractions, err = parseCount(field)
+			if err != nil {
+				parseError(fmt.Errorf("%w: %s outstanding critical infractions: %w", ErrParse, r.ID, err))
+			}
+		} else if lower := strings.ToLower(label); strings.Contains(lower, "risk") || strings.Contains(lower, "hazard") {
+			r.RiskCategory = parseRiskCategory(field)
+		} else if strings.Contains(lower, "inspections") && (strings.Contains(lower, "total") || strings.Contains(lower, "number")) {
+			statedInspections, err = parseCount(field)
+			if err != nil {
+				statedInspections = -1
+				parseError(fmt.Errorf("%w: %s total inspections: %w", ErrParse, r.ID, err))
+			}
+		}
+	})
+
+	var inspections []inspection
+	var rawRows []string
+	find(doc.Selection, "tr.hovereffect").Each(func(_ int, s *goquery.Selection) {
+		if *keepRaw {
+			raw, err := goquery.OuterHtml(s)
+			if err != nil {
+				parseError(fmt.Errorf("%w: %s raw inspection row: %w", ErrParse, r.ID, err))
+			}
+			rawRows = append(rawRows, raw)
+		}
+		var i inspection
+		i.Date = strings.TrimSpace(find(s, ".inspectionDate").Text())
+		// Relative dates are saved as absolute ones so they don't drift.
+		if date, ok := parseRelativeDate(i.Date, time.Now()); ok {
+			i.Date = date.Format(inspectionDateLayout)
+		}
+		i.Number = strings.TrimSpace(find(s, ".inspectionNumber").Text())
+		i.Reason = strings.TrimSpace(find(s, ".inspectionType").Text())
+		i.Type = parseInspectionType(i.Reason)
+		// Follow-ups may reference the inspection they follow up on.
+		for _, number := range inspectionNumberRegexp.FindAllString(s.Text(), -1) {
+			if number != i.Number {
+				i.FollowsUp = number
+				break
+			}
+		}
+		if href, ok := reportLink(s); ok {
+			i.ReportURL, err = resolveURL(r.MoreDetailsURL, href)
+			if err != nil {
+				parseError(fmt.Errorf("%w: %s inspection %s report URL: %w", ErrParse, r.ID, i.Number, err))
+			}
+		}
+		i.Critical, err = parseCount(find(s, ".criticalInfractionsCount").Text())
+		if err != nil {
+			parseError(fmt.Errorf("%w: %s inspection %s critical infractions: %w", ErrParse, r.ID, i.Number, err))
+		}
+		i.NonCritical, err = parseCount(find(s, ".nonCriticalInfractionsCount").Text())
+		if err != nil {
+			parseError(fmt.Errorf("%w: %s inspection %s non-critical infractions: %w", ErrParse, r.ID, i.Number, err))
+		}
+		// Not every page has a corrected column, so it's optional.
+		if corrected := s.Find(".correctedInfractionsCount"); corrected.Length() > 0 {
+			i.CorrectedCount, err = parseCount(corrected.Text())
+			if err != nil {
+				parseError(fmt.Errorf("%w: %s inspection %s corrected infractions: %w", ErrParse, r.ID, i.Number, err))
+			}
+		}
+		inspections = append(inspections, i)
+	})
+	inspections = dedupeInspections(inspections)
+	linkFollowUps(inspections)
+	r.Inspections = inspections
+	r.Trimmed = trimmedInspections{}
+	if *keepRaw {
+		r.RawRows = rawRows
+	}
+	// A short count usually means rows are being dropped by pagination or a
+	// stale selector, which otherwise goes unnoticed.
+	if statedInspections >= 0 && statedInspections != len(r.Inspections) {
+		log.Printf("%s (%s): summary states %d inspections but %d were parsed", r.Name, r.ID, statedInspections, len(r.Inspections))
+	}
+
+	// The hash is only saved for pages that parsed cleanly, so a partly
+	// parsed page is tried again rather than skipped as unchanged.
+	if parseErrors > 0 {
+		r.DetailHash = ""
+		return fmt.Errorf("%w: %d fields of %s", ErrParse, parseErrors, r.MoreDetailsURL)
+	}
+	r.DetailHash = hash
+	return nil
+}
+
+var (
+	shuffle            = flag.Bool("shuffle", false, "whether to fetch details pages in a random order")
+	deterministicOrder = flag.Bool("deterministic-order", false, "whether to fetch details pages in ID order, overriding -shuffle, so runs are repeatable")
+	seed               = flag.Int64("seed", 0, "seed for random choices, 0 uses the current time")
+)
+
+func newRand() *rand.Rand {
+	if *seed != 0 {
+		return rand.New(rand.NewSource(*seed))
+	}
+	return rand.New(rand.NewSource(time.Now().UnixNano()))
+}
+
+var checkpointEvery = flag.Int("checkpoint-every", 0, "save the DB after every N fetched restaurants, 0 only saves at the end")
+
+// fetchDetails fetches the details of the restaurants in rs that don't have
+// any inspections yet, or all of them if force is set. It returns the IDs of
+// the restaurants that failed to fetch or parse.
+func (db *db) fetchDetails(ctx context.Context, f Fetcher, rs []*restaurant, force bool) []string {
+	var todo []*restaurant
+	for _, r := range rs {
+		if !(len(r.Inspections) == 0 || force) {
+			continue
+		}
+		todo = append(todo, r)
+	}
+	switch {
+	case *deterministicOrder:
+		sort.Slice(todo, func(i, j int) bool {
+			return todo[i].ID < todo[j].ID
+		})
+	case *shuffle:
+		r := newRand()
+		r.Shuffle(len(todo), func(i, j int) {
+			todo[i], todo[j] = todo[j], todo[i]
+		})
+	}
+	bar := newProgress("Fetching", len(todo))
+	defer bar.finish()
+
+	var (
+		fetched  int64
+		failedMu sync.Mutex
+		failed   []string
+	)
+	rsChan := make(chan *restaurant, *workersFetch)
+	var wg sync.WaitGroup
+	for i := 0; i < *workersFetch; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for r := range rsChan {
+				// Fetch into a copy so checkpoints never save a half
+				// parsed restaurant.
+				c := *r
+				// Forced fetches re-parse unchanged pages too, so parser
+				// changes reach restaurants that are already saved.
+				if force {
+					c.DetailHash = ""
+				}
+				err := fetchDetail(ctx, f, &c)
+				bar.increment()
+				// Requests cut off by -max-runtime aren't failures.
+				if ctx.Err() != nil {
+					continue
+				}
+				if err != nil {
+					logError(err)
+					failedMu.Lock()
+					failed = append(failed, r.ID)
+					failedMu.Unlock()
+					// Keep what could be parsed from the page.
+					if !errors.Is(err, ErrParse) {
+						continue
+					}
+				}
+				db.mu.Lock()
+				*r = c
+				db.mu.Unlock()
+				if *stream {
+					streamRestaurant(os.Stdout, &c)
+				}
+
+				n := atomic.AddInt64(&fetched, 1)
+				if *checkpointEvery > 0 && n%int64(*checkpointEvery) == 0 {
+					infof("Checkpointing after %d restaurants", n)
+					if err := db.save(); err != nil {
+						logError(err)
+					}
+				}
+			}
+		}()
+	}
+feed:
+	for _, r := range todo {
+		select {
+		case rsChan <- r:
+		case <-ctx.Done():
+			break feed
+		}
 	}
 	close(rsChan)
 	wg.Wait()
+	if ctx.Err() != nil {
+		infof("Stopped fetching after %d restaurants: %v", atomic.LoadInt64(&fetched), ctx.Err())
+	}
+
+	sort.Strings(failed)
+	return failed
+}
+
+var (
+	failuresOut = flag.String("failures-out", "", "file to write the IDs of restaurants that failed to fetch to, one per line")
+	refetchIDs  = flag.String("refetch-ids", "", "file of restaurant IDs, one per line, to refetch instead of the usual restaurants")
+)
+
+var sample = flag.Int("sample", 0, "only fetch the details of this many random restaurants, 0 fetches all")
+
+// sampleRestaurants returns n random restaurants from rs, chosen with -seed.
+func sampleRestaurants(rs []*restaurant, n int) []*restaurant {
+	shuffled := append([]*restaurant(nil), rs...)
+	newRand().Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	if len(shuffled) > n {
+		shuffled = shuffled[:n]
+	}
+	return shuffled
+}
+
+func readIDs(file string) (map[string]bool, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	ids := map[string]bool{}
+	for _, id := range strings.Fields(string(b)) {
+		ids[id] = true
+	}
+	return ids, nil
 }
 
-var refetch = flag.Bool("refetch", false, "whether to refetch all restaurants")
+func writeIDs(file string, ids []string) error {
+	var b strings.Builder
+	for _, id := range ids {
+		b.WriteString(id)
+		b.WriteString("\n")
+	}
+	return os.WriteFile(file, []byte(b.String()), 0644)
+}
+
+var (
+	refetch    = flag.Bool("refetch", false, "whether to refetch all restaurants")
+	desc       = flag.Bool("desc", true, "whether to list the restaurants with the most infractions first")
+	allowEmpty = flag.Bool("allow-empty", false, "whether to allow an empty restaurant list to replace the DB")
+	newSince   = flag.String("new-since", "", "only fetch details for restaurants first listed on or after this date (YYYY-MM-DD)")
+	printURLs  = flag.Bool("print-urls", false, "whether to print the details URLs of the selected restaurants instead of fetching them")
+)
+
+var maxRuntime = flag.Duration("max-runtime", 0, "how long the whole run can take before in-flight fetches are canceled and what was fetched is saved, 0 is unlimited")
+
+var (
+	geocodeOnly = flag.Bool("geocode-only", false, "whether to only scrape the list if needed and geocode, without fetching details or writing output")
+	fetchOnly   = flag.Bool("fetch-only", false, "whether to skip geocoding and only fetch details and write output")
+)
 
 func generateRestaurantsList() error {
+	ctx := context.Background()
+	if *maxRuntime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *maxRuntime)
+		defer cancel()
+	}
+	start := time.Now()
 	db := makeDB()
 	if err := db.load(); err != nil {
 		return err
 	}
 	defer func() {
+		infof("Downloaded %s across %d requests", formatBytes(atomic.LoadInt64(&bytesDownloaded)), atomic.LoadInt64(&requestCount))
+		if *phaseTiming {
+			log.Printf("Time spent: fetch %s, parse %s, geocode %s", formatPhaseTime(&fetchTime), formatPhaseTime(&parseTime), formatPhaseTime(&geocodeTime))
+		}
+	}()
+	defer func() {
+		// Inspections are only trimmed when saving, so this run's output
+		// and filters see them all.
+		if *maxInspections > 0 {
+			trimInspections(db.Restaurants, *maxInspections)
+		}
+		db.UpdatedAt = time.Now()
+		db.RunDuration = db.UpdatedAt.Sub(start)
 		if err := db.save(); err != nil {
-			log.Println(err)
+			logError(err)
 		}
 	}()
+	if *selectorReport {
+		defer printSelectorReport(os.Stderr)
+	}
+	previous := copyRestaurants(db.Restaurants)
 
-	if len(db.Restaurants) == 0 || *refetch {
-		restaurants, err := getRestaurants()
+	if len(*seedDB) > 0 {
+		if err := db.seed(*seedDB); err != nil {
+			return err
+		}
+	}
+
+	if len(db.Restaurants) == 0 || *refetch || db.listStale() || len(*listFile) > 0 {
+		restaurants, err := getRestaurants(ctx, fetcher)
 		if err != nil {
 			return err
 		}
-		db.Restaurants = restaurants
+		// An empty list usually means the markup changed or we were blocked,
+		// so don't throw away a good DB because of it.
+		if len(restaurants) == 0 && len(db.Restaurants) > 0 && !*allowEmpty {
+			return errors.New("scraped zero restaurants; refusing to overwrite the DB (use -allow-empty to override)")
+		}
+		db.mergeRestaurants(restaurants)
+		db.ListFetchedAt = time.Now()
 	}
-	if err := db.geocodeRestaurants(); err != nil {
-		return err
+	// Geocoding and fetching details are independent passes, so a geocoding
+	// failure is logged and only returned once the details are fetched.
+	var geocodeErr error
+	if !*fetchOnly {
+		if geocodeErr = db.geocodeRestaurants(ctx); geocodeErr != nil && !*geocodeOnly {
+			infof("Geocoding failed, fetching details anyway: %v", geocodeErr)
+		}
+	}
+	if *geocodeOnly {
+		return geocodeErr
+	}
+	rs := db.getSelectedRestaurants()
+	if *printURLs {
+		for _, r := range rs {
+			fmt.Println(r.MoreDetailsURL)
+		}
+		return nil
+	}
+	if *listOnly {
+		rs = filterRestaurants(rs)
+		sort.SliceStable(rs, func(i, j int) bool {
+			return rs[i].Name < rs[j].Name
+		})
+		return writeOutput(ctx, rs)
 	}
-	ubc := db.getUBCRestaurants()
 	// Uncomment to fetch all details. Last time I did this I hit them too hard
 	// and they blocked me. :/
-	//fetchDetails(db.Restaurants)
-	fetchDetails(ubc)
+	//db.fetchDetails(ctx, fetcher, db.Restaurants, *refetch)
+	toFetch := db.getFetchRestaurants(rs)
+	force := *refetch
+	if len(*newSince) > 0 {
+		since, err := time.ParseInLocation("2006-01-02", *newSince, location)
+		if err != nil {
+			return fmt.Errorf("parsing -new-since: %w", err)
+		}
+		toFetch = addedSince(toFetch, since)
+	}
+	if len(*refetchIDs) > 0 {
+		ids, err := readIDs(*refetchIDs)
+		if err != nil {
+			return err
+		}
+		toFetch = nil
+		for _, r := range db.Restaurants {
+			if ids[r.ID] {
+				toFetch = append(toFetch, r)
+			}
+		}
+		force = true
+	}
+	if *sample > 0 {
+		toFetch = sampleRestaurants(toFetch, *sample)
+		force = true
+	}
+	// Closed restaurants' pages are usually gone, so fetching them would
+	// only log the same failures every run.
+	var open []*restaurant
+	for _, r := range toFetch {
+		if !r.Removed {
+			open = append(open, r)
+		}
+	}
+	toFetch = open
+	failed := db.fetchDetails(ctx, fetcher, toFetch, force)
+	if len(*failuresOut) > 0 {
+		if err := writeIDs(*failuresOut, failed); err != nil {
+			return err
+		}
+	}
+	if len(*downloadReportsDir) > 0 {
+		downloadReports(rs, *downloadReportsDir)
+	}
 	if err := computeInfractionsPastYear(db.Restaurants); err != nil {
 		return err
 	}
+	logAnomalies(rs)
+	notify(diffDBs(previous, db.Restaurants))
 
-	sort.Slice(ubc, func(i, j int) bool {
-		return ubc[i].InfractionsPastYear < ubc[j].InfractionsPastYear
-	})
-	printRestaurants(ubc)
+	rs = filterRestaurants(rs)
+	if err := sortRestaurants(rs); err != nil {
+		return err
+	}
+	// The list is streamed in place of being written to stdout.
+	if *stream && len(*outputDir) == 0 && len(*out) == 0 {
+		if err := streamRemaining(os.Stdout, rs); err != nil {
+			return err
+		}
+		return geocodeErr
+	}
+	if err := writeOutput(ctx, rs); err != nil {
+		return err
+	}
+	return geocodeErr
+}
+
+var (
+	sortBy    = flag.String("sort", "infractions", "how to sort the list: infractions, critical-ratio, or proximity to -center-lat and -center-lng")
+	centerLat = flag.Float64("center-lat", 0, "latitude to sort by proximity to")
+	centerLng = flag.Float64("center-lng", 0, "longitude to sort by proximity to")
+)
+
+// sortRestaurants sorts rs by -sort. Sorting by proximity sets DistanceKm and
+// puts restaurants that haven't been geocoded last.
+func sortRestaurants(rs []*restaurant) error {
+	switch *sortBy {
+	case "infractions":
+		sort.SliceStable(rs, func(i, j int) bool {
+			if *desc {
+				return rs[i].InfractionsPastYear > rs[j].InfractionsPastYear
+			}
+			return rs[i].InfractionsPastYear < rs[j].InfractionsPastYear
+		})
+	case "critical-ratio":
+		sort.SliceStable(rs, func(i, j int) bool {
+			if *desc {
+				return rs[i].CriticalRatio > rs[j].CriticalRatio
+			}
+			return rs[i].CriticalRatio < rs[j].CriticalRatio
+		})
+	case "proximity":
+		center := latLong{Lat: *centerLat, Long: *centerLng}
+		if center == (latLong{}) {
+			return errors.New("-sort proximity needs -center-lat and -center-lng")
+		}
+		for _, r := range rs {
+			r.DistanceKm = 0
+			if r.LatLong != (latLong{}) {
+				r.DistanceKm = haversine(center, r.LatLong)
+			}
+		}
+		sort.SliceStable(rs, func(i, j int) bool {
+			a, b := rs[i].LatLong != (latLong{}), rs[j].LatLong != (latLong{})
+			if a != b {
+				return a
+			}
+			return rs[i].DistanceKm < rs[j].DistanceKm
+		})
+	default:
+		return fmt.Errorf("unknown sort %q", *sortBy)
+	}
+	return nil
+}
 
+var (
+	show   = flag.String("show", "", "ID or name of a restaurant to print the full details of")
+	search = flag.String("search", "", "name of a restaurant to search for")
+)
+
+func (db *db) findRestaurant(id string) *restaurant {
+	for _, r := range db.Restaurants {
+		if r.ID == id {
+			return r
+		}
+	}
+	for _, r := range db.Restaurants {
+		if strings.EqualFold(r.Name, id) {
+			return r
+		}
+	}
+	return nil
+}
+
+func printRestaurant(r *restaurant) {
+	fmt.Printf("Name:          %s\n", r.Name)
+	fmt.Printf("ID:            %s\n", r.ID)
+	fmt.Printf("Facility Type: %s\n", r.FacilityType)
+	fmt.Printf("Community:     %s\n", r.Community)
+	fmt.Printf("Address:       %s\n", joinAddressLines(r.SiteAddress))
+	fmt.Printf("Phone:         %s\n", r.PhoneNumber)
+	fmt.Printf("Location:      %f, %f\n", r.LatLong.Lat, r.LatLong.Long)
+	fmt.Printf("Details:       %s\n", r.MoreDetailsURL)
+	fmt.Printf("Outstanding:   %d critical, %d non-critical\n", r.OutstandingCriticalInfractions, r.OutstandingNonCriticalInfractions)
+	fmt.Printf("Inspections:   %d\n", len(r.Inspections))
+	for _, i := range r.Inspections {
+		fmt.Printf("  %s  %-10s  %-20s  %d critical, %d non-critical\n", i.Date, i.Number, i.Reason, i.Critical, i.NonCritical)
+	}
+}
+
+func showRestaurant(id string) error {
+	db := makeDB()
+	if err := db.load(); err != nil {
+		return err
+	}
+	r := db.findRestaurant(id)
+	if r == nil {
+		fmt.Println("Did you mean:")
+		printMatches(db.searchRestaurants(id))
+		return fmt.Errorf("no restaurant with ID or name %q", id)
+	}
+	printRestaurant(r)
+	return nil
+}
+
+func searchRestaurants(query string) error {
+	db := makeDB()
+	if err := db.load(); err != nil {
+		return err
+	}
+	printMatches(db.searchRestaurants(query))
 	return nil
 }
 
 func main() {
 	flag.Parse()
+	setupClient()
+	setupSavedPages()
+	if err := setupTimezone(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupGeocoder(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupWindows(); err != nil {
+		log.Fatal(err)
+	}
+	if *workersFetch < 1 || *workersGeocode < 1 {
+		log.Fatal("-workers-fetch and -workers-geocode must be at least 1")
+	}
+	if *geocodeOnly && *fetchOnly {
+		log.Fatal("-geocode-only and -fetch-only can't be used together")
+	}
+	if *stream && *format != "jsonl" {
+		log.Fatal("-stream writes JSON lines and needs -format jsonl")
+	}
+	if *splitByCommunity && len(*outputDir) == 0 {
+		log.Fatal("-split-by-community needs -output-dir")
+	}
 	geocoder.SetAPIKey("AYrMZCLVncowATRyqAc10zotuHotsH1r")
 
+	if *show != "" {
+		if err := showRestaurant(*show); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *search != "" {
+		if err := searchRestaurants(*search); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *showStats {
+		if err := printStats(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *report != "" {
+		if err := printReport(*report); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *compare {
+		if flag.NArg() != 2 {
+			log.Fatal("-compare needs the paths of the old and new DBs")
+		}
+		if err := compareDBs(flag.Arg(0), flag.Arg(1)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(*exportSQLitePath) > 0 {
+		if err := exportSQLite(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *pruneCache {
+		if err := pruneGeocodeCache(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *verifyCache {
+		if err := verifyGeocodeCache(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *checkURLs {
+		if err := checkRestaurantURLs(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if err := generateRestaurantsList(); err != nil {
 		log.Fatal(err)
 	}
+	if n := atomic.LoadInt64(&errorCount); *failOnError && n > 0 {
+		log.Fatalf("%d errors occurred", n)
+	}
 }
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+var update = flag.Bool("update", false, "whether to rewrite the golden files in testdata from the current output")
+
+// setGlobal sets the package variable p points to, usually a flag, to v for
+// the rest of the test.
+func setGlobal[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// pageFetcher is a Fetcher that serves pages from memory, keyed by URL.
+type pageFetcher map[string]string
+
+func (f pageFetcher) Fetch(_ context.Context, url string) (*goquery.Document, error) {
+	page, ok := f[url]
+	if !ok {
+		return nil, fmt.Errorf("no page for %s", url)
+	}
+	return goquery.NewDocumentFromReader(strings.NewReader(page))
+}
+
+func restaurantIDs(rs []*restaurant) []string {
+	ids := []string{}
+	for _, r := range rs {
+		ids = append(ids, r.ID)
+	}
+	return ids
+}
+
+func TestGetUBCRestaurants(t *testing.T) {
+	db := makeDB()
+	db.Restaurants = []*restaurant{
+		{ID: "nest", LatLong: latLong{Lat: 49.2666, Long: -123.2500}},
+		{ID: "waterfront", LatLong: latLong{Lat: 49.2856, Long: -123.1115}},
+		{ID: "sauder", LatLong: latLong{Lat: 49.2648, Long: -123.2537}},
+		{ID: "granville", LatLong: latLong{Lat: 49.2827, Long: -123.1207}},
+		{ID: "wesbrook", LatLong: latLong{Lat: 49.2553, Long: -123.2353}},
+		{ID: "kitsilano", LatLong: latLong{Lat: 49.2684, Long: -123.1683}},
+		// Which side of the border an address that hasn't been geocoded is
+		// on isn't known, so it's never listed.
+		{ID: "ungeocoded", Community: vancouverWestside},
+	}
+
+	cases := []struct {
+		name      string
+		borderLng float64
+		want      []string
+	}{
+		{"default", -123.227883, []string{"nest", "sauder", "wesbrook"}},
+		// With the sign flipped every restaurant in Vancouver is west of the
+		// border, which is what the default case guards against.
+		{"sign flipped", 123.227883, []string{"nest", "waterfront", "sauder", "granville", "wesbrook", "kitsilano"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			setGlobal(t, borderLng, c.borderLng)
+			if got := restaurantIDs(db.getUBCRestaurants()); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("getUBCRestaurants() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestWriteMarkdownEscapesPipes(t *testing.T) {
+	rs := []*restaurant{{
+		ID:             "1",
+		Name:           "Fish | Chips\nBar",
+		MoreDetailsURL: "https://example.com/a|b",
+		Inspections:    []inspection{{Date: "01-Jan-2017"}},
+	}}
+	var buf bytes.Buffer
+	if err := writeMarkdown(&buf, rs); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want a header, divider and one row:\n%s", len(lines), buf.String())
+	}
+	cells := func(line string) int {
+		return strings.Count(line, "|") - strings.Count(line, "\\|")
+	}
+	if got, want := cells(lines[2]), cells(lines[0]); got != want {
+		t.Errorf("row has %d cell delimiters, want %d like the header:\n%s", got, want, buf.String())
+	}
+	if !strings.Contains(lines[2], "Fish \\| Chips Bar") {
+		t.Errorf("row %q doesn't contain the escaped name", lines[2])
+	}
+}
+
+func TestParseInspectionType(t *testing.T) {
+	cases := []struct {
+		reason string
+		want   inspectionType
+	}{
+		{"Routine", inspectionRoutine},
+		{"Routine Inspection", inspectionRoutine},
+		{"Follow-Up", inspectionFollowUp},
+		{"follow up", inspectionFollowUp},
+		{"Complaint", inspectionComplaint},
+		{"COMPLAINT - Pests", inspectionComplaint},
+		{"Opening Inspection", inspectionOther},
+		{"", inspectionOther},
+	}
+	for _, c := range cases {
+		if got := parseInspectionType(c.reason); got != c.want {
+			t.Errorf("parseInspectionType(%q) = %s, want %s", c.reason, got, c.want)
+		}
+	}
+}
+
+func TestComputeInfractionsAsOf(t *testing.T) {
+	now := time.Date(2017, time.March, 1, 15, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name        string
+		inspections []inspection
+		pastYear    int
+		total       int
+		wantErr     bool
+	}{
+		{name: "no inspections"},
+		{
+			name:        "exactly a year ago",
+			inspections: []inspection{{Date: "01-Mar-2016", Critical: 1, NonCritical: 2}},
+			pastYear:    3,
+			total:       3,
+		},
+		{
+			name:        "a year and a day ago",
+			inspections: []inspection{{Date: "29-Feb-2016", Critical: 1, NonCritical: 2}},
+			total:       3,
+		},
+		{
+			name:        "today",
+			inspections: []inspection{{Date: "01-Mar-2017", NonCritical: 1}},
+			pastYear:    1,
+			total:       1,
+		},
+		{
+			name:        "future dated",
+			inspections: []inspection{{Date: "02-Mar-2017", Critical: 4}},
+			total:       4,
+		},
+		{
+			name: "spanning the window",
+			inspections: []inspection{
+				{Date: "15-Jan-2017", Critical: 1},
+				{Date: "10-Jun-2016", NonCritical: 2},
+				{Date: "10-Jun-2015", Critical: 3, NonCritical: 4},
+			},
+			pastYear: 3,
+			total:    10,
+		},
+		{
+			name:        "unparseable date",
+			inspections: []inspection{{Date: "sometime", Critical: 1}},
+			wantErr:     true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			setGlobal(t, &location, time.UTC)
+			r := &restaurant{ID: "1", Inspections: c.inspections}
+			err := computeInfractionsAsOf([]*restaurant{r}, now)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("computeInfractionsAsOf() error = %v, want error %t", err, c.wantErr)
+			}
+			if c.wantErr {
+				return
+			}
+			if r.InfractionsPastYear != c.pastYear || r.InfractionsTotal != c.total {
+				t.Errorf("past year, total = %d, %d, want %d, %d", r.InfractionsPastYear, r.InfractionsTotal, c.pastYear, c.total)
+			}
+		})
+	}
+}
+
+func TestGetRestaurantsMultiLineAddress(t *testing.T) {
+	f := pageFetcher{restaurantsURL: `<table>
+<tr class="hovereffect" onclick="location.href='/FoodPremises/Details/abc'">
+<td class="facilityName">Cafe</td>
+<td class="siteAddress">
+  6138 Student Union Blvd<br>
+  Unit 5<br><br>
+  <div>Vancouver, BC</div>
+</td>
+</tr>
+</table>`}
+	rs, err := getRestaurants(context.Background(), f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 1 {
+		t.Fatalf("got %d restaurants, want 1", len(rs))
+	}
+	if got, want := rs[0].SiteAddress, "6138 Student Union Blvd\nUnit 5\nVancouver, BC"; got != want {
+		t.Errorf("SiteAddress = %q, want %q", got, want)
+	}
+	if got, want := joinAddressLines(rs[0].SiteAddress), "6138 Student Union Blvd, Unit 5, Vancouver, BC"; got != want {
+		t.Errorf("joined address = %q, want %q", got, want)
+	}
+}
+
+func TestGetUBCRestaurantsOnBorder(t *testing.T) {
+	db := makeDB()
+	db.Restaurants = []*restaurant{
+		{ID: "west", LatLong: latLong{Lat: 49.26, Long: -123.23}},
+		{ID: "on", LatLong: latLong{Lat: 49.26, Long: -123.2}},
+		{ID: "east", LatLong: latLong{Lat: 49.26, Long: -123.1}},
+	}
+	setGlobal(t, borderLng, -123.2)
+	for _, inclusive := range []bool{false, true} {
+		setGlobal(t, borderInclusive, inclusive)
+		want := []string{"west"}
+		if inclusive {
+			want = append(want, "on")
+		}
+		if got := restaurantIDs(db.getUBCRestaurants()); !reflect.DeepEqual(got, want) {
+			t.Errorf("with -border-inclusive=%t getUBCRestaurants() = %v, want %v", inclusive, got, want)
+		}
+	}
+}
+
+func TestFetchDetailDuplicateRows(t *testing.T) {
+	const url = "https://inspections.vcha.ca/FoodPremises/Details/abc"
+	f := pageFetcher{url: `<table>
+<tr class="hovereffect"><td class="inspectionDate">10-Jan-2017</td><td class="inspectionNumber">INS1</td><td class="inspectionType">Routine</td><td class="criticalInfractionsCount">1</td><td class="nonCriticalInfractionsCount">2</td></tr>
+<tr class="hovereffect"><td class="inspectionDate">10-Jan-2017</td><td class="inspectionNumber">INS1</td><td class="inspectionType">Routine</td><td class="criticalInfractionsCount">1</td><td class="nonCriticalInfractionsCount">2</td><td><a href="/Reports/INS1.pdf">Report</a></td></tr>
+<tr class="hovereffect"><td class="inspectionDate">03-Feb-2017</td><td class="inspectionNumber"></td><td class="inspectionType">Complaint</td><td class="criticalInfractionsCount">0</td><td class="nonCriticalInfractionsCount">1</td></tr>
+<tr class="hovereffect"><td class="inspectionDate">03-Feb-2017</td><td class="inspectionNumber"></td><td class="inspectionType">Complaint</td><td class="criticalInfractionsCount">0</td><td class="nonCriticalInfractionsCount">1</td></tr>
+</table>`}
+	r := &restaurant{ID: "abc", MoreDetailsURL: url}
+	if err := fetchDetail(context.Background(), f, r); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Inspections) != 2 {
+		t.Fatalf("got %d inspections, want 2: %+v", len(r.Inspections), r.Inspections)
+	}
+	if got, want := r.Inspections[0].ReportURL, "https://inspections.vcha.ca/Reports/INS1.pdf"; got != want {
+		t.Errorf("kept the copy with ReportURL %q, want the one with %q", got, want)
+	}
+}
+
+func TestFetchDetailNonBreakingSpaces(t *testing.T) {
+	const url = "https://inspections.vcha.ca/FoodPremises/Details/abc"
+	f := pageFetcher{url: "<table>" +
+		`<tr class="nozebrastripes"><td class="display-label">Outstanding Critical Infractions</td><td class="display-field">&nbsp;3</td></tr>` +
+		`<tr class="hovereffect"><td class="inspectionDate">10-Jan-2017</td><td class="inspectionNumber">INS1</td>` +
+		"<td class=\"criticalInfractionsCount\">\u00a02\u00a0</td><td class=\"nonCriticalInfractionsCount\">1&nbsp;</td></tr>" +
+		"</table>"}
+	r := &restaurant{ID: "abc", MoreDetailsURL: url}
+	if err := fetchDetail(context.Background(), f, r); err != nil {
+		t.Fatal(err)
+	}
+	if r.OutstandingCriticalInfractions != 3 {
+		t.Errorf("OutstandingCriticalInfractions = %d, want 3", r.OutstandingCriticalInfractions)
+	}
+	if len(r.Inspections) != 1 {
+		t.Fatalf("got %d inspections, want 1", len(r.Inspections))
+	}
+	if i := r.Inspections[0]; i.Critical != 2 || i.NonCritical != 1 {
+		t.Errorf("critical, non-critical = %d, %d, want 2, 1", i.Critical, i.NonCritical)
+	}
+}
+
+// TestParseGolden parses the saved pages in testdata and compares the
+// restaurants to testdata/golden.json. Run go test -update to regenerate it
+// when the parser is meant to change.
+func TestParseGolden(t *testing.T) {
+	setGlobal(t, quiet, true)
+	f := savedPageFetcher{
+		listFile:   filepath.Join("testdata", "list.html"),
+		detailsDir: filepath.Join("testdata", "details"),
+	}
+	ctx := context.Background()
+	rs, err := getRestaurants(ctx, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range rs {
+		if err := fetchDetail(ctx, f, r); err != nil {
+			t.Errorf("fetchDetail(%s): %v", r.ID, err)
+		}
+	}
+	got, err := json.MarshalIndent(rs, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+
+	golden := filepath.Join("testdata", "golden.json")
+	if *update {
+		if err := os.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("parsed restaurants don't match %s, run go test -update if the change is intended:\n%s", golden, got)
+	}
+}
+
+func TestFetchDetailRetriesParseErrors(t *testing.T) {
+	const url = "https://inspections.vcha.ca/FoodPremises/Details/abc"
+	f := pageFetcher{url: `<table>
+<tr class="hovereffect"><td class="inspectionDate">10-Jan-2017</td><td class="inspectionNumber">INS1</td><td class="criticalInfractionsCount">one</td><td class="nonCriticalInfractionsCount">2</td></tr>
+</table>`}
+	setGlobal(t, quiet, true)
+	r := &restaurant{ID: "abc", MoreDetailsURL: url}
+	for i := 0; i < 2; i++ {
+		if err := fetchDetail(context.Background(), f, r); !errors.Is(err, ErrParse) {
+			t.Fatalf("fetchDetail() call %d = %v, want %v", i+1, err, ErrParse)
+		}
+	}
+}
+
+func TestTrimInspectionsKeepsTotals(t *testing.T) {
+	setGlobal(t, &location, time.UTC)
+	r := &restaurant{ID: "1", Inspections: []inspection{
+		{Date: "10-Jun-2016", Critical: 2, NonCritical: 4},
+		{Date: "15-Jan-2019", NonCritical: 1},
+	}}
+	trimInspections([]*restaurant{r}, 1)
+	if len(r.Inspections) != 1 || r.Inspections[0].Date != "15-Jan-2019" {
+		t.Fatalf("kept %+v, want only the newest inspection", r.Inspections)
+	}
+	now := time.Date(2019, time.March, 1, 0, 0, 0, 0, time.UTC)
+	if err := computeInfractionsAsOf([]*restaurant{r}, now); err != nil {
+		t.Fatal(err)
+	}
+	if r.InfractionsPastYear != 1 || r.InfractionsTotal != 7 {
+		t.Errorf("past year, total = %d, %d, want 1, 7", r.InfractionsPastYear, r.InfractionsTotal)
+	}
+}
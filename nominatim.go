@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	nominatimURL = "https://nominatim.openstreetmap.org/search"
+	// nominatimInterval is the minimum time between requests allowed by
+	// Nominatim's usage policy.
+	nominatimInterval = time.Second
+)
+
+// nominatimGeocoder geocodes with OpenStreetMap's Nominatim API, which needs
+// no API key but only allows one request a second.
+type nominatimGeocoder struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+type nominatimResult struct {
+	Lat string `json:"lat"`
+	Lon string `json:"lon"`
+}
+
+func (g *nominatimGeocoder) Geocode(address string) (latLong, error) {
+	g.mu.Lock()
+	if wait := nominatimInterval - time.Since(g.last); wait > 0 {
+		time.Sleep(wait)
+	}
+	g.last = time.Now()
+	g.mu.Unlock()
+
+	req, err := http.NewRequest("GET", nominatimURL+"?"+url.Values{
+		"q":      {address},
+		"format": {"json"},
+		"limit":  {"1"},
+	}.Encode(), nil)
+	if err != nil {
+		return latLong{}, err
+	}
+	// Nominatim requires an identifying user agent.
+	req.Header.Set("User-Agent", "ubc-food-safety")
+	resp, err := client.Do(req)
+	if err != nil {
+		return latLong{}, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return latLong{}, fmt.Errorf("%w: %s", ErrGeocodeRateLimited, resp.Status)
+	case resp.StatusCode == http.StatusForbidden:
+		return latLong{}, fmt.Errorf("%w: %s", ErrGeocodeAuth, resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return latLong{}, fmt.Errorf("nominatim: %s", resp.Status)
+	}
+
+	var results []nominatimResult
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return latLong{}, fmt.Errorf("%w: nominatim response: %w", ErrParse, err)
+	}
+	if len(results) == 0 {
+		return latLong{}, ErrGeocodeNotFound
+	}
+	lat, err := strconv.ParseFloat(results[0].Lat, 64)
+	if err != nil {
+		return latLong{}, fmt.Errorf("%w: nominatim latitude: %w", ErrParse, err)
+	}
+	lng, err := strconv.ParseFloat(results[0].Lon, 64)
+	if err != nil {
+		return latLong{}, fmt.Errorf("%w: nominatim longitude: %w", ErrParse, err)
+	}
+	return latLong{Lat: lat, Long: lng}, nil
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	format           = flag.String("format", "markdown", "output format: markdown, csv, json, jsonl, geojson or kml")
+	outputDir        = flag.String("output-dir", "", "directory to write the restaurant list into in every format, instead of writing -format to stdout")
+	stream           = flag.Bool("stream", false, "whether to print each selected restaurant as a JSON line as soon as its details are fetched, unsorted, followed by the ones that weren't fetched; needs -format jsonl")
+	splitByCommunity = flag.Bool("split-by-community", false, "with -output-dir, whether to write a set of files per community named after it")
+	listOnly         = flag.Bool("list-only", false, "whether to only scrape and geocode the restaurant list and output a directory of restaurants, without fetching any details pages")
+)
+
+var columns = flag.String("columns", "", "comma separated optional columns to add to the markdown output: community, critical-ratio, distance, map, overdue, risk, status, streak")
+
+type column struct {
+	Header string
+	Value  func(r *restaurant) string
+}
+
+var optionalColumns = map[string]column{
+	"community": {
+		Header: "Community",
+		Value: func(r *restaurant) string {
+			return r.Community
+		},
+	},
+	"critical-ratio": {
+		Header: "Critical Ratio",
+		Value: func(r *restaurant) string {
+			return strconv.FormatFloat(r.CriticalRatio, 'f', 2, 64)
+		},
+	},
+	"distance": {
+		Header: "Distance (km)",
+		Value: func(r *restaurant) string {
+			if r.LatLong == (latLong{}) {
+				return ""
+			}
+			return strconv.FormatFloat(r.DistanceKm, 'f', 2, 64)
+		},
+	},
+	"map": {
+		Header: "Map",
+		Value: func(r *restaurant) string {
+			if u := r.mapURL(); len(u) > 0 {
+				return fmt.Sprintf("[Map](%s)", u)
+			}
+			return ""
+		},
+	},
+	"overdue": {
+		Header: "Days Since Inspection (Median Gap)",
+		Value: func(r *restaurant) string {
+			v := fmt.Sprintf("%d (%d)", r.DaysSinceInspection, r.MedianInspectionGapDays)
+			if r.Overdue {
+				v += " overdue"
+			}
+			return v
+		},
+	},
+	"risk": {
+		Header: "Risk Category",
+		Value: func(r *restaurant) string {
+			return r.RiskCategory
+		},
+	},
+	"status": {
+		Header: "Status",
+		Value: func(r *restaurant) string {
+			if r.Removed {
+				return "Removed " + r.RemovedAt.Format("2006-01-02")
+			}
+			return "Active"
+		},
+	},
+	"streak": {
+		Header: "Clean Streak",
+		Value: func(r *restaurant) string {
+			return strconv.Itoa(r.CleanStreak)
+		},
+	},
+}
+
+// selectedColumns returns the optional columns requested with -columns in
+// order, followed by a column for each of the -windows. The community column
+// is always shown when listing more than one community, the distance column
+// when sorting by proximity and the status column when listing removed
+// restaurants.
+func selectedColumns() ([]column, error) {
+	names := strings.Split(*columns, ",")
+	if *includeRemoved {
+		names = append([]string{"status"}, names...)
+	}
+	if *sortBy == "proximity" {
+		names = append([]string{"distance"}, names...)
+	}
+	if len(selectedCommunities()) > 1 {
+		names = append([]string{"community"}, names...)
+	}
+
+	var cs []column
+	seen := map[string]bool{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 || seen[name] {
+			continue
+		}
+		seen[name] = true
+		c, ok := optionalColumns[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+		cs = append(cs, c)
+	}
+	for _, w := range infractionWindows {
+		cs = append(cs, column{
+			Header: fmt.Sprintf("Infractions (%s)", w.Name),
+			Value: func(r *restaurant) string {
+				return strconv.Itoa(r.InfractionsByWindow[w.Name])
+			},
+		})
+	}
+	return cs, nil
+}
+
+// mapURL links to r's coordinates on Google Maps so the geocoding can be
+// checked by eye.
+func (r *restaurant) mapURL() string {
+	if r.LatLong == (latLong{}) {
+		return ""
+	}
+	return fmt.Sprintf("https://www.google.com/maps?q=%f,%f", r.LatLong.Lat, r.LatLong.Long)
+}
+
+// writeOutput writes rs to -output-dir or -out if set, or stdout.
+func writeOutput(ctx context.Context, rs []*restaurant) error {
+	if len(*outputDir) > 0 {
+		return writeOutputDir(*outputDir, rs)
+	}
+	if len(*out) > 0 {
+		return writeOut(ctx, rs)
+	}
+	return writeRestaurants(os.Stdout, rs)
+}
+
+func writeRestaurants(w io.Writer, rs []*restaurant) error {
+	return writeFormat(w, *format, rs)
+}
+
+func writeFormat(w io.Writer, format string, rs []*restaurant) error {
+	if *anonymize {
+		rs = anonymizeRestaurants(rs)
+	}
+	switch format {
+	case "markdown":
+		if *listOnly {
+			return writeDirectory(w, rs)
+		}
+		return writeMarkdown(w, rs)
+	case "csv":
+		return writeCSV(w, rs)
+	case "json":
+		return writeJSON(w, rs)
+	case "jsonl":
+		return writeJSONLines(w, rs)
+	case "geojson":
+		return writeGeoJSON(w, rs)
+	case "kml":
+		return writeKML(w, rs)
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// outputFiles are the extensions of the files -output-dir writes and their
+// formats.
+var outputFiles = []struct {
+	Ext, Format string
+}{
+	{".md", "markdown"},
+	{".csv", "csv"},
+	{".json", "json"},
+	{".geojson", "geojson"},
+}
+
+// communitySlug returns the file name -split-by-community uses for community,
+// e.g. "vancouver-westside" for "Vancouver - Westside".
+func communitySlug(community string) string {
+	slug := strings.Trim(nonSlugRegexp.ReplaceAllString(strings.ToLower(community), "-"), "-")
+	if len(slug) == 0 {
+		return "unknown"
+	}
+	return slug
+}
+
+var nonSlugRegexp = regexp.MustCompile(`[^a-z0-9]+`)
+
+// writeOutputDir writes rs into dir in every format, or with
+// -split-by-community a set of files per community. rs is already sorted and
+// filtered, so each community's files keep that order.
+func writeOutputDir(dir string, rs []*restaurant) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	rs = outputDirRestaurants(rs)
+	if !*splitByCommunity {
+		return writeOutputFiles(dir, "restaurants", rs)
+	}
+
+	var communities []string
+	byCommunity := map[string][]*restaurant{}
+	for _, r := range rs {
+		slug := communitySlug(r.Community)
+		if _, ok := byCommunity[slug]; !ok {
+			communities = append(communities, slug)
+		}
+		byCommunity[slug] = append(byCommunity[slug], r)
+	}
+	for _, slug := range communities {
+		if err := writeOutputFiles(dir, slug, byCommunity[slug]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// outputDirRestaurants returns the restaurants of rs that the files
+// -output-dir writes should hold. The markdown and CSV skip restaurants
+// without inspections unless -list-only is set, so the JSON does too. The
+// maps can only place restaurants that have been geocoded, but the tables
+// still list the rest.
+func outputDirRestaurants(rs []*restaurant) []*restaurant {
+	var out []*restaurant
+	for _, r := range rs {
+		if len(r.Inspections) == 0 && !*listOnly {
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// writeOutputFiles writes rs into dir as name with every extension. Each file
+// is written to a temporary file first so a publish step never picks up a
+// partial one.
+func writeOutputFiles(dir, name string, rs []*restaurant) error {
+	for _, o := range outputFiles {
+		file := filepath.Join(dir, name+o.Ext)
+		tmp := file + ".tmp"
+		f, err := os.Create(tmp)
+		if err != nil {
+			return err
+		}
+		w := bufio.NewWriter(f)
+		err = writeFormat(w, o.Format, rs)
+		if err == nil {
+			err = w.Flush()
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("writing %s: %w", file, err)
+		}
+		if err := os.Rename(tmp, file); err != nil {
+			return err
+		}
+	}
+	infof("Wrote %d restaurants to %s", len(rs), filepath.Join(dir, name))
+	return nil
+}
+
+// writeDirectory writes the list page fields of rs as a markdown table, for
+// -list-only runs that have no inspections to rank by.
+func writeDirectory(w io.Writer, rs []*restaurant) error {
+	fmt.Fprintln(w, "|Name|Facility Type|Community|Address|Phone Number||")
+	fmt.Fprintln(w, "|---|---|---|---|---|---|")
+	for _, r := range rs {
+		if _, err := fmt.Fprintf(w, "|%s|%s|%s|%s|%s|[Details](%s)|\n", escapeMarkdown(r.Name), escapeMarkdown(r.FacilityType), escapeMarkdown(r.Community), escapeMarkdown(joinAddressLines(r.SiteAddress)), escapeMarkdown(r.PhoneNumber), escapeMarkdown(r.MoreDetailsURL)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var csvHeader = []string{
+	"ID", "Name", "Facility Type", "Risk Category", "Community", "Address", "Phone Number",
+	"Latitude", "Longitude", "Infractions (Past Year)", "Infractions (Total)",
+	"Outstanding Critical Infractions", "Outstanding Non-Critical Infractions",
+	"Clean Streak", "Days Since Inspection", "Details URL",
+}
+
+// writeCSV writes rs as CSV with a header row. Like the markdown output,
+// restaurants without inspections are skipped unless -list-only is set.
+func writeCSV(w io.Writer, rs []*restaurant) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, r := range rs {
+		if len(r.Inspections) == 0 && !*listOnly {
+			continue
+		}
+		var lat, long string
+		if r.LatLong != (latLong{}) {
+			lat = strconv.FormatFloat(r.LatLong.Lat, 'f', -1, 64)
+			long = strconv.FormatFloat(r.LatLong.Long, 'f', -1, 64)
+		}
+		if err := writer.Write([]string{
+			r.ID,
+			r.Name,
+			r.FacilityType,
+			r.RiskCategory,
+			r.Community,
+			joinAddressLines(r.SiteAddress),
+			r.PhoneNumber,
+			lat,
+			long,
+			strconv.Itoa(r.InfractionsPastYear),
+			strconv.Itoa(r.InfractionsTotal),
+			strconv.Itoa(r.OutstandingCriticalInfractions),
+			strconv.Itoa(r.OutstandingNonCriticalInfractions),
+			strconv.Itoa(r.CleanStreak),
+			strconv.Itoa(r.DaysSinceInspection),
+			r.MoreDetailsURL,
+		}); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// boundsOf returns the south west and north east corners of the box containing
+// every geocoded restaurant in rs.
+func boundsOf(rs []*restaurant) (min, max latLong) {
+	first := true
+	for _, r := range rs {
+		ll := r.LatLong
+		if ll == (latLong{}) {
+			continue
+		}
+		if first {
+			min, max = ll, ll
+			first = false
+			continue
+		}
+		if ll.Lat < min.Lat {
+			min.Lat = ll.Lat
+		}
+		if ll.Long < min.Long {
+			min.Long = ll.Long
+		}
+		if ll.Lat > max.Lat {
+			max.Lat = ll.Lat
+		}
+		if ll.Long > max.Long {
+			max.Long = ll.Long
+		}
+	}
+	return min, max
+}
+
+type bounds struct {
+	Min, Max latLong
+}
+
+type jsonOutput struct {
+	Bounds      bounds
+	Restaurants []*restaurant
+}
+
+func writeJSON(w io.Writer, rs []*restaurant) error {
+	min, max := boundsOf(rs)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(jsonOutput{
+		Bounds:      bounds{Min: min, Max: max},
+		Restaurants: rs,
+	})
+}
+
+var (
+	streamMu sync.Mutex
+	// streamed is the IDs of the restaurants -stream has printed.
+	streamed = map[string]bool{}
+)
+
+// streamRestaurant writes r as a JSON line for -stream if it passes the
+// output filters. Its infraction counts are computed on a copy since the
+// whole DB's are only computed at the end.
+func streamRestaurant(w io.Writer, r *restaurant) {
+	c := *r
+	if err := computeInfractionsAsOf([]*restaurant{&c}, time.Now()); err != nil {
+		logError(err)
+	}
+	streamMu.Lock()
+	defer streamMu.Unlock()
+	streamed[c.ID] = true
+	if err := writeFormat(w, "jsonl", filterRestaurants([]*restaurant{&c})); err != nil {
+		logError(err)
+	}
+}
+
+// streamRemaining writes the restaurants of rs that -stream hasn't printed
+// yet, such as the ones whose details were already fetched, so the stream
+// holds the same restaurants the list would.
+func streamRemaining(w io.Writer, rs []*restaurant) error {
+	streamMu.Lock()
+	defer streamMu.Unlock()
+	var remaining []*restaurant
+	for _, r := range rs {
+		if !streamed[r.ID] {
+			remaining = append(remaining, r)
+		}
+	}
+	return writeFormat(w, "jsonl", remaining)
+}
+
+// writeJSONLines writes each restaurant as a JSON object on its own line.
+func writeJSONLines(w io.Writer, rs []*restaurant) error {
+	encoder := json.NewEncoder(w)
+	for _, r := range rs {
+		if err := encoder.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type geoJSONGeometry struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   geoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	BBox     []float64        `json:"bbox,omitempty"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+// writeGeoJSON writes rs as a GeoJSON FeatureCollection of points. Restaurants
+// that haven't been geocoded are skipped.
+func writeGeoJSON(w io.Writer, rs []*restaurant) error {
+	collection := geoJSONFeatureCollection{
+		Type:     "FeatureCollection",
+		Features: []geoJSONFeature{},
+	}
+	for _, r := range rs {
+		if r.LatLong == (latLong{}) {
+			continue
+		}
+		collection.Features = append(collection.Features, geoJSONFeature{
+			Type: "Feature",
+			Geometry: geoJSONGeometry{
+				Type:        "Point",
+				Coordinates: []float64{r.LatLong.Long, r.LatLong.Lat},
+			},
+			Properties: map[string]interface{}{
+				"id":                     r.ID,
+				"name":                   r.Name,
+				"facilityType":           r.FacilityType,
+				"community":              r.Community,
+				"address":                r.SiteAddress,
+				"infractionsPastYear":    r.InfractionsPastYear,
+				"infractionsTotal":       r.InfractionsTotal,
+				"outstandingCritical":    r.OutstandingCriticalInfractions,
+				"outstandingNonCritical": r.OutstandingNonCriticalInfractions,
+				"detailsURL":             r.MoreDetailsURL,
+				"mapURL":                 r.mapURL(),
+			},
+		})
+	}
+	if len(collection.Features) > 0 {
+		min, max := boundsOf(rs)
+		collection.BBox = []float64{min.Long, min.Lat, max.Long, max.Lat}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(collection)
+}
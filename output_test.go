@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestBoundsOf(t *testing.T) {
+	cases := []struct {
+		name     string
+		rs       []*restaurant
+		min, max latLong
+	}{
+		{"empty", nil, latLong{}, latLong{}},
+		{"ungeocoded only", []*restaurant{{}}, latLong{}, latLong{}},
+		{
+			"one point",
+			[]*restaurant{{LatLong: latLong{Lat: 49.2666, Long: -123.25}}},
+			latLong{Lat: 49.2666, Long: -123.25},
+			latLong{Lat: 49.2666, Long: -123.25},
+		},
+		{
+			"ignores ungeocoded",
+			[]*restaurant{
+				{LatLong: latLong{Lat: 49.2666, Long: -123.25}},
+				{},
+				{LatLong: latLong{Lat: 49.2553, Long: -123.2353}},
+				{LatLong: latLong{Lat: 49.2648, Long: -123.2537}},
+			},
+			latLong{Lat: 49.2553, Long: -123.2537},
+			latLong{Lat: 49.2666, Long: -123.2353},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			min, max := boundsOf(c.rs)
+			if min != c.min || max != c.max {
+				t.Errorf("boundsOf() = %v, %v, want %v, %v", min, max, c.min, c.max)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var showProgress = flag.Bool("progress", false, "whether to show a progress bar, or periodic progress logs when not on a terminal")
+
+const (
+	progressWidth       = 30
+	progressLogInterval = 10 * time.Second
+)
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// progress tracks how much of a phase is done. It draws a bar on stderr, so
+// it stays out of the output, when that's a terminal and otherwise logs
+// periodically, so cron output doesn't fill up with control characters.
+type progress struct {
+	name  string
+	total int
+	tty   bool
+	start time.Time
+
+	mu      sync.Mutex
+	done    int
+	lastLog time.Time
+}
+
+func newProgress(name string, total int) *progress {
+	now := time.Now()
+	return &progress{
+		name:    name,
+		total:   total,
+		tty:     isTerminal(os.Stderr),
+		start:   now,
+		lastLog: now,
+	}
+}
+
+func (p *progress) eta() time.Duration {
+	if p.done == 0 {
+		return 0
+	}
+	elapsed := time.Since(p.start)
+	return (elapsed / time.Duration(p.done) * time.Duration(p.total-p.done)).Round(time.Second)
+}
+
+func (p *progress) increment() {
+	if !*showProgress {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done++
+	if p.tty {
+		filled := progressWidth
+		if p.total > 0 {
+			filled = progressWidth * p.done / p.total
+		}
+		bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressWidth-filled)
+		fmt.Fprintf(os.Stderr, "\r%s [%s] %d/%d ETA %s\x1b[K", p.name, bar, p.done, p.total, p.eta())
+		return
+	}
+	if time.Since(p.lastLog) >= progressLogInterval || p.done == p.total {
+		p.lastLog = time.Now()
+		infof("%s: %d/%d, ETA %s", p.name, p.done, p.total, p.eta())
+	}
+}
+
+// finish ends the bar's line so later output starts on a new one.
+func (p *progress) finish() {
+	if !*showProgress || !p.tty {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintln(os.Stderr)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+var report = flag.String("report", "", "print a report from the saved DB instead of the restaurant list: community, overdue, removed, risk, worst-by-type, anomalies, summary-json, tiers")
+
+var (
+	tierCritical = flag.Int("tier-critical", 1, "outstanding critical infractions that put a restaurant in the critical action tier")
+	tierWatch    = flag.Int("tier-watch", 1, "infractions in the past year that put a restaurant in the watch tier")
+)
+
+type groupStats struct {
+	Group string
+	// Restaurants is the number of restaurants in the group and Inspected is
+	// how many of those have had their details fetched.
+	Restaurants, Inspected int
+	Infractions            int
+	AverageInfractions     float64
+	OutstandingCritical    int
+}
+
+// groupReport groups rs by key. Averages are over inspected restaurants only
+// since the rest have no infraction data.
+func groupReport(rs []*restaurant, key func(r *restaurant) string) []groupStats {
+	byGroup := map[string]*groupStats{}
+	var stats []*groupStats
+	for _, r := range rs {
+		group := key(r)
+		s, ok := byGroup[group]
+		if !ok {
+			s = &groupStats{Group: group}
+			byGroup[group] = s
+			stats = append(stats, s)
+		}
+		s.Restaurants++
+		if len(r.Inspections) > 0 {
+			s.Inspected++
+		}
+		s.Infractions += r.InfractionsTotal
+		if r.OutstandingCriticalInfractions > 0 {
+			s.OutstandingCritical++
+		}
+	}
+
+	out := make([]groupStats, 0, len(stats))
+	for _, s := range stats {
+		if s.Inspected > 0 {
+			s.AverageInfractions = float64(s.Infractions) / float64(s.Inspected)
+		}
+		out = append(out, *s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Group < out[j].Group
+	})
+	return out
+}
+
+func printGroupReport(title string, stats []groupStats) {
+	fmt.Printf("|%s|Restaurants|Inspected|Infractions (Total)|Average Infractions|Outstanding Critical|\n", title)
+	fmt.Println("|---|---|---|---|---|---|")
+	for _, s := range stats {
+		fmt.Printf("|%s|%d|%d|%d|%.2f|%d|\n", escapeMarkdown(s.Group), s.Restaurants, s.Inspected, s.Infractions, s.AverageInfractions, s.OutstandingCritical)
+	}
+}
+
+type groupWorst struct {
+	Group      string
+	Restaurant *restaurant
+}
+
+// worstBy returns the restaurant with the most infractions in the past year
+// for each group, ignoring restaurants with no inspections.
+func worstBy(rs []*restaurant, key func(r *restaurant) string) []groupWorst {
+	worst := map[string]*restaurant{}
+	for _, r := range rs {
+		if len(r.Inspections) == 0 || r.Removed {
+			continue
+		}
+		group := key(r)
+		if w, ok := worst[group]; !ok || r.InfractionsPastYear > w.InfractionsPastYear {
+			worst[group] = r
+		}
+	}
+
+	var out []groupWorst
+	for group, r := range worst {
+		out = append(out, groupWorst{Group: group, Restaurant: r})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Group < out[j].Group
+	})
+	return out
+}
+
+func printWorstReport(title string, worst []groupWorst) {
+	fmt.Printf("|%s|Name|Infractions (Past Year)|Infractions (Total)|Outstanding Critical Infractions||\n", title)
+	fmt.Println("|---|---|---|---|---|---|")
+	for _, w := range worst {
+		r := w.Restaurant
+		fmt.Printf("|%s|%s|%d|%d|%d|[Details](%s)|\n", escapeMarkdown(w.Group), escapeMarkdown(r.Name), r.InfractionsPastYear, r.InfractionsTotal, r.OutstandingCriticalInfractions, escapeMarkdown(r.MoreDetailsURL))
+	}
+}
+
+func printRemovedReport(rs []*restaurant) {
+	fmt.Println("|Name|Community|Address|Removed|ID|")
+	fmt.Println("|---|---|---|---|---|")
+	for _, r := range rs {
+		if !r.Removed {
+			continue
+		}
+		fmt.Printf("|%s|%s|%s|%s|%s|\n", escapeMarkdown(r.Name), escapeMarkdown(r.Community), escapeMarkdown(r.SiteAddress), r.RemovedAt.Format("2006-01-02"), r.ID)
+	}
+}
+
+// printOverdueReport lists restaurants that have gone much longer than usual
+// without an inspection, longest first.
+func printOverdueReport(rs []*restaurant) {
+	var overdue []*restaurant
+	for _, r := range rs {
+		if r.Overdue && !r.Removed {
+			overdue = append(overdue, r)
+		}
+	}
+	sort.Slice(overdue, func(i, j int) bool {
+		return overdue[i].DaysSinceInspection > overdue[j].DaysSinceInspection
+	})
+
+	fmt.Println("|Name|Community|Days Since Inspection|Median Gap (Days)||")
+	fmt.Println("|---|---|---|---|---|")
+	for _, r := range overdue {
+		fmt.Printf("|%s|%s|%d|%d|[Details](%s)|\n", escapeMarkdown(r.Name), escapeMarkdown(r.Community), r.DaysSinceInspection, r.MedianInspectionGapDays, escapeMarkdown(r.MoreDetailsURL))
+	}
+}
+
+// anomalies returns why r's outstanding infraction counts, which come from the
+// details page summary, can't be reconciled with its inspection history. These
+// usually mean part of the page failed to parse.
+func anomalies(r *restaurant) []string {
+	if r.OutstandingCriticalInfractions == 0 && r.OutstandingNonCriticalInfractions == 0 {
+		return nil
+	}
+	if len(r.Inspections)+r.Trimmed.Inspections == 0 {
+		return []string{"outstanding infractions but no inspections"}
+	}
+	critical, nonCritical := r.Trimmed.Critical, r.Trimmed.NonCritical
+	for _, i := range r.Inspections {
+		critical += i.Critical
+		nonCritical += i.NonCritical
+	}
+	var problems []string
+	if r.OutstandingCriticalInfractions > critical {
+		problems = append(problems, fmt.Sprintf("%d outstanding critical but %d recorded", r.OutstandingCriticalInfractions, critical))
+	}
+	if r.OutstandingNonCriticalInfractions > nonCritical {
+		problems = append(problems, fmt.Sprintf("%d outstanding non-critical but %d recorded", r.OutstandingNonCriticalInfractions, nonCritical))
+	}
+	return problems
+}
+
+// logAnomalies warns about restaurants with implausible outstanding counts so
+// they don't silently skew the ranking.
+func logAnomalies(rs []*restaurant) {
+	n := 0
+	for _, r := range rs {
+		if problems := anomalies(r); len(problems) > 0 {
+			debugf("%s (%s): %s", r.Name, r.ID, strings.Join(problems, ", "))
+			n++
+		}
+	}
+	if n > 0 {
+		infof("%d restaurants have outstanding infractions inconsistent with their inspections, see -report anomalies", n)
+	}
+}
+
+func printAnomaliesReport(rs []*restaurant) {
+	fmt.Println("|Name|Community|Problems||")
+	fmt.Println("|---|---|---|---|")
+	for _, r := range rs {
+		problems := anomalies(r)
+		if len(problems) == 0 || r.Removed {
+			continue
+		}
+		fmt.Printf("|%s|%s|%s|[Details](%s)|\n", escapeMarkdown(r.Name), escapeMarkdown(r.Community), escapeMarkdown(strings.Join(problems, "; ")), escapeMarkdown(r.MoreDetailsURL))
+	}
+}
+
+// tierNames are the -report tiers buckets, most urgent first.
+var tierNames = []string{"Critical action needed", "Watch", "Clean"}
+
+// tier returns the index in tierNames of the bucket r belongs in.
+func tier(r *restaurant) int {
+	switch {
+	case r.OutstandingCriticalInfractions >= *tierCritical:
+		return 0
+	case r.InfractionsPastYear >= *tierWatch:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// printTiersReport buckets the inspected restaurants of rs into triage tiers,
+// each sorted by infractions in the past year.
+func printTiersReport(rs []*restaurant) {
+	tiers := make([][]*restaurant, len(tierNames))
+	for _, r := range rs {
+		if r.Removed || len(r.Inspections) == 0 {
+			continue
+		}
+		t := tier(r)
+		tiers[t] = append(tiers[t], r)
+	}
+	for t, name := range tierNames {
+		sort.SliceStable(tiers[t], func(i, j int) bool {
+			return tiers[t][i].InfractionsPastYear > tiers[t][j].InfractionsPastYear
+		})
+		if t > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("## %s (%d)\n\n", name, len(tiers[t]))
+		fmt.Println("|Name|Infractions (Past Year)|Outstanding Critical Infractions|Outstanding Non-Critical Infractions||")
+		fmt.Println("|---|---|---|---|---|")
+		for _, r := range tiers[t] {
+			fmt.Printf("|%s|%d|%d|%d|[Details](%s)|\n", escapeMarkdown(r.Name), r.InfractionsPastYear, r.OutstandingCriticalInfractions, r.OutstandingNonCriticalInfractions, escapeMarkdown(r.MoreDetailsURL))
+		}
+	}
+}
+
+func printReport(name string) error {
+	db := makeDB()
+	if err := db.load(); err != nil {
+		return err
+	}
+	if err := computeInfractionsPastYear(db.Restaurants); err != nil {
+		return err
+	}
+
+	switch name {
+	case "community":
+		printGroupReport("Community", groupReport(db.Restaurants, func(r *restaurant) string {
+			return r.Community
+		}))
+	case "overdue":
+		printOverdueReport(db.Restaurants)
+	case "risk":
+		printGroupReport("Risk Category", groupReport(db.Restaurants, func(r *restaurant) string {
+			if len(r.RiskCategory) == 0 {
+				return "Unknown"
+			}
+			return r.RiskCategory
+		}))
+	case "worst-by-type":
+		printWorstReport("Facility Type", worstBy(db.Restaurants, func(r *restaurant) string {
+			return r.FacilityType
+		}))
+	case "removed":
+		printRemovedReport(db.Restaurants)
+	case "anomalies":
+		printAnomaliesReport(db.Restaurants)
+	case "tiers":
+		printTiersReport(db.getSelectedRestaurants())
+	case "summary-json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(summarize(db))
+	default:
+		return fmt.Errorf("unknown report %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+var (
+	listFile   = flag.String("list-file", "", "saved HTML of the restaurant list to parse instead of fetching it")
+	detailsDir = flag.String("details-dir", "", "directory of saved details pages, named by restaurant ID with an optional .html extension, to parse instead of fetching them")
+)
+
+// savedPageFetcher serves the restaurant list from -list-file and details
+// pages from -details-dir, so parsing bugs can be reproduced against a
+// snapshot without network access. Pages it has no file for come from next.
+type savedPageFetcher struct {
+	listFile, detailsDir string
+	next                 Fetcher
+}
+
+// setupSavedPages replaces fetcher with a savedPageFetcher if -list-file or
+// -details-dir is set.
+func setupSavedPages() {
+	if len(*listFile) == 0 && len(*detailsDir) == 0 {
+		return
+	}
+	fetcher = savedPageFetcher{listFile: *listFile, detailsDir: *detailsDir, next: fetcher}
+}
+
+func (f savedPageFetcher) Fetch(ctx context.Context, addr string) (*goquery.Document, error) {
+	if addr == restaurantsURL {
+		if len(f.listFile) == 0 {
+			return f.next.Fetch(ctx, addr)
+		}
+		return readSavedPage(f.listFile)
+	}
+	if len(f.detailsDir) == 0 {
+		return f.next.Fetch(ctx, addr)
+	}
+	// A missing page is an error rather than a fetch so -details-dir runs
+	// never touch the network.
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	file := filepath.Join(f.detailsDir, path.Base(u.Path))
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		file += ".html"
+	}
+	return readSavedPage(file)
+}
+
+func readSavedPage(file string) (*goquery.Document, error) {
+	infof("Reading: %s", file)
+	r, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	doc, err := goquery.NewDocumentFromReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrParse, file, err)
+	}
+	return doc, nil
+}
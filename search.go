@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxCandidates is the number of fuzzy matches shown when a lookup doesn't
+// find an exact match.
+const maxCandidates = 5
+
+type match struct {
+	Restaurant *restaurant
+	Score      float64
+}
+
+func levenshtein(a, b string) int {
+	ar, br := []rune(a), []rune(b)
+	prev := make([]int, len(br)+1)
+	cur := make([]int, len(br)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ar); i++ {
+		cur[0] = i
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(br)]
+}
+
+// similarity scores how well name matches query between 0 and 1. It takes the
+// better of the edit distance similarity and the fraction of query words that
+// appear in the name, so partial names like "tastes" still rank well.
+func similarity(query, name string) float64 {
+	query = strings.ToLower(strings.TrimSpace(query))
+	name = strings.ToLower(strings.TrimSpace(name))
+	if query == name {
+		return 1
+	}
+
+	longest := max(len([]rune(query)), len([]rune(name)))
+	if longest == 0 {
+		return 0
+	}
+	edit := 1 - float64(levenshtein(query, name))/float64(longest)
+
+	words := strings.Fields(query)
+	if len(words) == 0 {
+		return edit
+	}
+	nameWords := map[string]bool{}
+	for _, w := range strings.Fields(name) {
+		nameWords[w] = true
+	}
+	found := 0
+	for _, w := range words {
+		if nameWords[w] {
+			found++
+		}
+	}
+	// Scale token overlap down slightly so an exact name always wins.
+	overlap := 0.99 * float64(found) / float64(len(words))
+
+	return max(edit, overlap)
+}
+
+func (db *db) searchRestaurants(query string) []match {
+	var matches []match
+	for _, r := range db.Restaurants {
+		matches = append(matches, match{Restaurant: r, Score: similarity(query, r.Name)})
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Score > matches[j].Score
+	})
+	if len(matches) > maxCandidates {
+		matches = matches[:maxCandidates]
+	}
+	return matches
+}
+
+func printMatches(matches []match) {
+	for _, m := range matches {
+		fmt.Printf("%s  %s (%s, %.0f%%)\n", m.Restaurant.ID, m.Restaurant.Name, m.Restaurant.Community, m.Score*100)
+	}
+}
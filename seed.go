@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+var seedDB = flag.String("seed-db", "", "CSV of restaurants to merge into the DB before scraping, with a header row of name, address, community and url columns")
+
+// seedColumns maps CSV header names to the restaurant fields they set.
+var seedColumns = map[string]func(r *restaurant, v string){
+	"id":           func(r *restaurant, v string) { r.ID = v },
+	"name":         func(r *restaurant, v string) { r.Name = v },
+	"address":      func(r *restaurant, v string) { r.SiteAddress = v },
+	"community":    func(r *restaurant, v string) { r.Community = v },
+	"url":          func(r *restaurant, v string) { r.MoreDetailsURL = v },
+	"facilitytype": func(r *restaurant, v string) { r.FacilityType = v },
+	"phone":        func(r *restaurant, v string) { r.PhoneNumber = v },
+}
+
+func readSeedCSV(r io.Reader) ([]*restaurant, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w: seed CSV header: %w", ErrParse, err)
+	}
+	setters := make([]func(r *restaurant, v string), len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.Join(strings.Fields(name), ""))
+		setter, ok := seedColumns[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown seed column %q", ErrParse, header[i])
+		}
+		setters[i] = setter
+	}
+
+	var rs []*restaurant
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: seed CSV: %w", ErrParse, err)
+		}
+		var r restaurant
+		for i, v := range record {
+			setters[i](&r, strings.TrimSpace(v))
+		}
+		if len(r.ID) == 0 && len(r.MoreDetailsURL) > 0 {
+			r.ID = path.Base(r.MoreDetailsURL)
+		}
+		rs = append(rs, &r)
+	}
+	return rs, nil
+}
+
+func seedKey(r *restaurant) string {
+	return strings.ToLower(strings.TrimSpace(r.Name)) + "|" + normalizeAddress(r.SiteAddress)
+}
+
+// seed merges the restaurants in the -seed-db CSV into the DB. Restaurants
+// are matched by ID, or by name and address if the CSV has no ID, and only
+// empty fields of existing restaurants are filled in.
+func (db *db) seed(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	seeds, err := readSeedCSV(f)
+	if err != nil {
+		return err
+	}
+
+	byKey := map[string]*restaurant{}
+	for _, r := range db.Restaurants {
+		if len(r.ID) > 0 {
+			byKey[r.ID] = r
+		}
+		byKey[seedKey(r)] = r
+	}
+	added := 0
+	for _, s := range seeds {
+		existing, ok := byKey[s.ID]
+		if !ok || len(s.ID) == 0 {
+			existing, ok = byKey[seedKey(s)]
+		}
+		if !ok {
+			db.Restaurants = append(db.Restaurants, s)
+			if len(s.ID) > 0 {
+				byKey[s.ID] = s
+			}
+			byKey[seedKey(s)] = s
+			added++
+			continue
+		}
+		fillEmpty(&existing.Name, s.Name)
+		fillEmpty(&existing.SiteAddress, s.SiteAddress)
+		fillEmpty(&existing.Community, s.Community)
+		fillEmpty(&existing.MoreDetailsURL, s.MoreDetailsURL)
+		fillEmpty(&existing.FacilityType, s.FacilityType)
+		fillEmpty(&existing.PhoneNumber, s.PhoneNumber)
+	}
+	infof("Seeded %d restaurants, %d new", len(seeds), added)
+	return nil
+}
+
+func fillEmpty(field *string, v string) {
+	if len(*field) == 0 {
+		*field = v
+	}
+}
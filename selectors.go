@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+var selectorReport = flag.Bool("selector-report", false, "whether to print which CSS selectors matched nothing while parsing")
+
+type selectorStats struct {
+	Uses, Empty int
+}
+
+var (
+	selectorsMu sync.Mutex
+	selectors   = map[string]*selectorStats{}
+)
+
+// find is s.Find that, with -selector-report, records whether sel matched
+// anything so markup changes show up as broken selectors rather than blank
+// fields.
+func find(s *goquery.Selection, sel string) *goquery.Selection {
+	found := s.Find(sel)
+	if !*selectorReport {
+		return found
+	}
+
+	selectorsMu.Lock()
+	defer selectorsMu.Unlock()
+	stats, ok := selectors[sel]
+	if !ok {
+		stats = &selectorStats{}
+		selectors[sel] = stats
+	}
+	stats.Uses++
+	if found.Length() == 0 {
+		stats.Empty++
+	}
+	return found
+}
+
+func printSelectorReport(w io.Writer) {
+	selectorsMu.Lock()
+	defer selectorsMu.Unlock()
+
+	var sels []string
+	for sel := range selectors {
+		sels = append(sels, sel)
+	}
+	sort.Strings(sels)
+
+	fmt.Fprintln(w, "Selectors that matched nothing:")
+	empty := 0
+	for _, sel := range sels {
+		stats := selectors[sel]
+		if stats.Empty == 0 {
+			continue
+		}
+		empty++
+		fmt.Fprintf(w, "  %s: %d of %d lookups\n", sel, stats.Empty, stats.Uses)
+	}
+	if empty == 0 {
+		fmt.Fprintln(w, "  none")
+	}
+}
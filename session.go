@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ErrSessionExpired is returned when the inspections site serves its session
+// expired or login page instead of the page requested and a new session
+// couldn't be started.
+var ErrSessionExpired = errors.New("session expired")
+
+const sessionCookie = "ASP.NET_SessionId"
+
+var (
+	sessionMu sync.Mutex
+	sessionID = "uiktkmxmg2fq3jw1pvwc4kgp"
+	// renewMu stops every worker renewing the session at once when it
+	// expires.
+	renewMu sync.Mutex
+)
+
+func currentSession() string {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	return sessionID
+}
+
+// sessionMarkers are phrases only found on the site's session expired pages.
+var sessionMarkers = [][]byte{
+	[]byte("session has expired"),
+	[]byte("session expired"),
+	[]byte("session has timed out"),
+}
+
+// sessionExpired reports whether resp, with the given body, is the site's
+// session expired page, or a redirect to its login page, rather than the page
+// that was requested.
+func sessionExpired(resp *http.Response, body []byte) bool {
+	if resp.Request != nil && strings.Contains(strings.ToLower(resp.Request.URL.Path), "login") {
+		return true
+	}
+	lower := bytes.ToLower(body)
+	for _, marker := range sessionMarkers {
+		if bytes.Contains(lower, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// bootstrapSession starts a new session by requesting the site's home page
+// without a cookie and keeping the one the site sets. expired is the session that was
+// found to have expired; if another worker already replaced it nothing is
+// done.
+func bootstrapSession(ctx context.Context, c *http.Client, expired string) error {
+	renewMu.Lock()
+	defer renewMu.Unlock()
+	if currentSession() != expired {
+		return nil
+	}
+
+	// The home page is much cheaper than the full list.
+	home, err := resolveURL(restaurantsURL, "/")
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", home, nil)
+	if err != nil {
+		return err
+	}
+	// A cached response would hand back the session that just expired.
+	req.Header.Set("Cache-Control", "no-cache")
+	throttle(req.URL.Host)
+	infof("Starting a new session")
+	resp, err := c.Do(req)
+	if err != nil {
+		return fmt.Errorf("starting session: %w", err)
+	}
+	resp.Body.Close()
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == sessionCookie && len(cookie.Value) > 0 {
+			sessionMu.Lock()
+			sessionID = cookie.Value
+			sessionMu.Unlock()
+			return nil
+		}
+	}
+	return fmt.Errorf("starting session: no %s cookie in response", sessionCookie)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+var showStats = flag.Bool("stats", false, "whether to print statistics about the saved DB instead of fetching")
+
+type dbStats struct {
+	Restaurants, Inspected, Geocoded, UBC int
+	Removed                               int
+	Infractions                           int
+	OutstandingCritical                   int
+	OutstandingNonCritical                int
+	// OldestInspection and NewestInspection are zero if there are no
+	// inspections with parseable dates.
+	OldestInspection, NewestInspection time.Time
+}
+
+func (db *db) stats() dbStats {
+	var s dbStats
+	for _, r := range db.Restaurants {
+		s.Restaurants++
+		if r.Removed {
+			s.Removed++
+		}
+		if len(r.Inspections) > 0 {
+			s.Inspected++
+		}
+		if r.LatLong != (latLong{}) {
+			s.Geocoded++
+		}
+		for _, i := range r.Inspections {
+			s.Infractions += i.Critical + i.NonCritical
+			date, err := parseInspectionDate(i.Date)
+			if err != nil {
+				continue
+			}
+			if s.OldestInspection.IsZero() || date.Before(s.OldestInspection) {
+				s.OldestInspection = date
+			}
+			if date.After(s.NewestInspection) {
+				s.NewestInspection = date
+			}
+		}
+		s.OutstandingCritical += r.OutstandingCriticalInfractions
+		s.OutstandingNonCritical += r.OutstandingNonCriticalInfractions
+	}
+	s.UBC = len(db.getUBCRestaurants())
+	return s
+}
+
+// printStats prints a quick health check of the saved DB without touching the
+// network.
+func printStats() error {
+	db := makeDB()
+	if err := db.load(); err != nil {
+		return err
+	}
+	s := db.stats()
+	date := func(t time.Time) string {
+		if t.IsZero() {
+			return "none"
+		}
+		return t.Format("2006-01-02")
+	}
+	fmt.Printf("Restaurants:              %d (%d removed)\n", s.Restaurants, s.Removed)
+	fmt.Printf("With inspections:         %d\n", s.Inspected)
+	fmt.Printf("Geocoded:                 %d\n", s.Geocoded)
+	fmt.Printf("UBC:                      %d\n", s.UBC)
+	fmt.Printf("Infractions:              %d\n", s.Infractions)
+	fmt.Printf("Outstanding critical:     %d\n", s.OutstandingCritical)
+	fmt.Printf("Outstanding non-critical: %d\n", s.OutstandingNonCritical)
+	fmt.Printf("Oldest inspection:        %s\n", date(s.OldestInspection))
+	fmt.Printf("Newest inspection:        %s\n", date(s.NewestInspection))
+	return nil
+}
+
+// Summary is the aggregate numbers for the listed restaurants, small enough
+// for a dashboard to poll.
+type Summary struct {
+	UpdatedAt   time.Time `json:",omitzero"`
+	RunSeconds  float64
+	Restaurants int
+	Inspected   int
+	// InfractionsPastYear and InfractionsTotal are summed over the listed
+	// restaurants.
+	InfractionsPastYear, InfractionsTotal int
+	OutstandingCritical                   int
+	WorstOffender                         *SummaryRestaurant `json:",omitempty"`
+}
+
+// SummaryRestaurant identifies a restaurant in a Summary.
+type SummaryRestaurant struct {
+	ID                  string
+	Name                string
+	InfractionsPastYear int
+	MoreDetailsURL      string
+}
+
+// summarize summarizes the restaurants the list would include. The
+// infraction metrics must already have been computed.
+func summarize(db *db) Summary {
+	s := Summary{
+		UpdatedAt:  db.UpdatedAt,
+		RunSeconds: db.RunDuration.Seconds(),
+	}
+	var worst *restaurant
+	for _, r := range db.getSelectedRestaurants() {
+		if r.Removed {
+			continue
+		}
+		s.Restaurants++
+		if len(r.Inspections) > 0 {
+			s.Inspected++
+		}
+		s.InfractionsPastYear += r.InfractionsPastYear
+		s.InfractionsTotal += r.InfractionsTotal
+		s.OutstandingCritical += r.OutstandingCriticalInfractions
+		if r.InfractionsPastYear > 0 && (worst == nil || r.InfractionsPastYear > worst.InfractionsPastYear) {
+			worst = r
+		}
+	}
+	if worst != nil {
+		s.WorstOffender = &SummaryRestaurant{
+			ID:                  worst.ID,
+			Name:                worst.Name,
+			InfractionsPastYear: worst.InfractionsPastYear,
+			MoreDetailsURL:      worst.MoreDetailsURL,
+		}
+	}
+	return s
+}
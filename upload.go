@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+var out = flag.String("out", "", "file to write the output to instead of stdout, or an s3:// or gs:// URL to upload it to when built with the s3 or gcs tag")
+
+// uploaders upload output to a bucket URL, keyed by scheme. They're
+// registered by files behind build tags so the cloud SDKs are only needed by
+// builds that use them.
+var uploaders = map[string]func(ctx context.Context, u *url.URL, data []byte, contentType string) error{}
+
+// uploadTags are the build tags that register each uploader.
+var uploadTags = map[string]string{
+	"s3": "s3",
+	"gs": "gcs",
+}
+
+var contentTypes = map[string]string{
+	"markdown": "text/markdown; charset=utf-8",
+	"csv":      "text/csv; charset=utf-8",
+	"json":     "application/json",
+	"jsonl":    "application/x-ndjson",
+	"geojson":  "application/geo+json",
+	"kml":      "application/vnd.google-earth.kml+xml",
+}
+
+// writeOut writes rs in -format to -out.
+func writeOut(ctx context.Context, rs []*restaurant) error {
+	var buf bytes.Buffer
+	if err := writeRestaurants(&buf, rs); err != nil {
+		return err
+	}
+
+	u, err := url.Parse(*out)
+	if err == nil {
+		if tag, ok := uploadTags[u.Scheme]; ok {
+			upload, ok := uploaders[u.Scheme]
+			if !ok {
+				return fmt.Errorf("-out %s needs a build with -tags %s", *out, tag)
+			}
+			infof("Uploading %d bytes to %s", buf.Len(), *out)
+			// Publish what was fetched even if -max-runtime has passed.
+			return upload(context.WithoutCancel(ctx), u, buf.Bytes(), contentTypes[*format])
+		}
+	}
+
+	if dir := filepath.Dir(*out); len(dir) > 0 {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	tmp := *out + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, *out)
+}
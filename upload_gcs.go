@@ -0,0 +1,33 @@
+//go:build gcs
+
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+func init() {
+	uploaders["gs"] = uploadGCS
+}
+
+// uploadGCS uploads data to the gs://bucket/object URL u using the default
+// Google Cloud credentials.
+func uploadGCS(ctx context.Context, u *url.URL, data []byte, contentType string) error {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	w := client.Bucket(u.Host).Object(strings.TrimPrefix(u.Path, "/")).NewWriter(ctx)
+	w.ContentType = contentType
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
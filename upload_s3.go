@@ -0,0 +1,34 @@
+//go:build s3
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func init() {
+	uploaders["s3"] = uploadS3
+}
+
+// uploadS3 uploads data to the s3://bucket/key URL u using the default AWS
+// credentials.
+func uploadS3(ctx context.Context, u *url.URL, data []byte, contentType string) error {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = s3.NewFromConfig(cfg).PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(u.Host),
+		Key:         aws.String(strings.TrimPrefix(u.Path, "/")),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(contentType),
+	})
+	return err
+}